@@ -6,10 +6,13 @@ package mqtrans
 
 import (
     "fmt"
+    "runtime/debug"
+    "sync"
     "time"
     "net/url"
 
     "app/pmlog"
+    "app/pmtools"
 
     mqtt "github.com/eclipse/paho.mqtt.golang"
 )
@@ -23,20 +26,38 @@ const (
     QosL2       byte            = 2
     QosL3       byte            = 4
 
-    clientId    string          = "pm-xxxx"
+    clientIdPrefix string       = "pm-"
+    quiesceTime uint            = 250 // ms, to complete in-flight messages
+    defaultPort string          = "1883"
 )
 
+// ConnectionHandler is called when the transport connects
+// to the broker or loses the connection
+type ConnectionHandler = func(connected bool, err error)
+
 type Transport struct {
     mc          mqtt.Client
     clientId    string
+    onConnection ConnectionHandler
+    // topics to subscribe again after reconnect, the broker
+    // drops them with the clean session
+    subscriptions   map[string]mqtt.MessageHandler
+    subMutex        sync.Mutex
+    logger          *pmlog.Logger
 }
 
 func NewTransport() *Transport {
     var transport Transport
-    transport.clientId = clientId
+    transport.clientId = clientIdPrefix + pmtools.GetNewUUID()[:8]
+    transport.subscriptions = make(map[string]mqtt.MessageHandler)
+    transport.logger = pmlog.NewLogger("mqtt").With("client", transport.clientId)
     return &transport
 }
 
+func (this *Transport) SetConnectionHandler(onConnection ConnectionHandler) {
+    this.onConnection = onConnection
+}
+
 func (this *Transport) Bind(mqRef string) error {
     var err error
 
@@ -47,6 +68,9 @@ func (this *Transport) Bind(mqRef string) error {
 
     hostname    := mqURL.Hostname()
     port        := mqURL.Port()
+    if len(port) == 0 {
+        port = defaultPort
+    }
 
     username    := mqURL.User.Username()
     password, _ := mqURL.User.Password()
@@ -66,17 +90,34 @@ func (this *Transport) Bind(mqRef string) error {
     opts.SetKeepAlive(keepalive)
     opts.SetPingTimeout(pingTimeout)
 
+    logger := this.logger.With("broker", hostname)
     onConnectHandler := func(client mqtt.Client) {
-        pmlog.LogInfo("mqtt transport connected to broker:", hostname )
+        logger.Info("connected to broker")
+        this.resubscribe()
+        if this.onConnection != nil {
+            this.onConnection(true, nil)
+        }
     }
     opts.SetOnConnectHandler(onConnectHandler)
 
+    onConnectionLostHandler := func(client mqtt.Client, err error) {
+        logger.Warning("lost connection to broker", "error", err)
+        if this.onConnection != nil {
+            this.onConnection(false, err)
+        }
+    }
+    opts.SetConnectionLostHandler(onConnectionLostHandler)
+
     onReconnectHandler := func(client mqtt.Client, opts *mqtt.ClientOptions) {
-        pmlog.LogInfo("mqtt transport reconnected to broker", hostname)
+        logger.Info("reconnecting to broker")
         time.Sleep(1 * time.Second)
     }
     opts.SetReconnectingHandler(onReconnectHandler)
 
+    this.subMutex.Lock()
+    this.subscriptions = make(map[string]mqtt.MessageHandler)
+    this.subMutex.Unlock()
+
     this.mc = mqtt.NewClient(opts)
 
     token := this.mc.Connect()
@@ -106,13 +147,53 @@ func (this *Transport) Publish(topic string, message string) error {
 func (this *Transport) Subscribe(topic string, callback Handler) error {
     var err error
 
+    // a panic of the callback must not break the client
     mqttHandler := func(mqttClient mqtt.Client, mqttMessage mqtt.Message) {
+        defer func() {
+            if value := recover(); value != nil {
+                this.logger.Error("handler panic", "topic", mqttMessage.Topic(), "panic", value,
+                            "stack", string(debug.Stack()))
+            }
+        }()
         callback(mqttMessage.Topic(), mqttMessage.Payload())
     }
 
     token := this.mc.Subscribe(topic, QosL1, mqttHandler)
     for !token.WaitTimeout(waitTimeout * time.Second) {}
 
+    err = token.Error()
+    if err != nil {
+        return err
+    }
+    this.subMutex.Lock()
+    this.subscriptions[topic] = mqttHandler
+    this.subMutex.Unlock()
+    return err
+}
+
+func (this *Transport) resubscribe() {
+    this.subMutex.Lock()
+    defer this.subMutex.Unlock()
+    for topic, mqttHandler := range this.subscriptions {
+        token := this.mc.Subscribe(topic, QosL1, mqttHandler)
+        for !token.WaitTimeout(waitTimeout * time.Second) {}
+        err := token.Error()
+        if err != nil {
+            this.logger.Warning("unable resubscribe topic", "topic", topic, "error", err)
+        }
+    }
+}
+
+func (this *Transport) Unsubscribe(topic string) error {
+    var err error
+
+    this.subMutex.Lock()
+    delete(this.subscriptions, topic)
+    this.subMutex.Unlock()
+
+    token := this.mc.Unsubscribe(topic)
+    for !token.WaitTimeout(waitTimeout * time.Second) {}
+
     err = token.Error()
     if err != nil {
         return err
@@ -122,8 +203,8 @@ func (this *Transport) Subscribe(topic string, callback Handler) error {
 
 func (this *Transport) Disconnect() error {
     var err error
-    if this.mc.IsConnected() {
-        this.mc.Disconnect(1)
+    if this.mc != nil && this.mc.IsConnected() {
+        this.mc.Disconnect(quiesceTime)
     }
     return err
 }
@@ -0,0 +1,138 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmalert
+
+import (
+    "encoding/json"
+    "sync"
+    "time"
+
+    "app/pmlog"
+    "app/pmtools"
+)
+
+type Level string
+
+const (
+    LevelInfo       Level = "info"
+    LevelWarning    Level = "warning"
+    LevelCritical   Level = "critical"
+
+    recentLimit     int = 1024
+)
+
+//
+// Alert
+//
+type Alert struct {
+    Id          string      `json:"id"`
+    Time        time.Time   `json:"time"`
+    Level       Level       `json:"level"`
+    Source      string      `json:"source"`
+    DriverId    string      `json:"driverId"`
+    Subject     string      `json:"subject"`
+    Message     string      `json:"message"`
+}
+
+func NewAlert(level Level, source, driverId, subject, message string) *Alert {
+    return &Alert{
+        Id:         pmtools.GetNewUUID(),
+        Time:       time.Now(),
+        Level:      level,
+        Source:     source,
+        DriverId:   driverId,
+        Subject:    subject,
+        Message:    message,
+    }
+}
+
+func (this *Alert) ToJson() []byte {
+    jsonBytes, _ := json.Marshal(this)
+    return jsonBytes
+}
+
+// Channel delivers alerts to operators
+type Channel interface {
+    SendAlert(alert *Alert) error
+}
+
+//
+// Alerter
+//
+type Alerter struct {
+    channels    []Channel
+    recent      []*Alert
+    mutex       sync.RWMutex
+}
+
+func NewAlerter() *Alerter {
+    var alerter Alerter
+    alerter.channels = make([]Channel, 0)
+    alerter.recent   = make([]*Alert, 0)
+    return &alerter
+}
+
+func (this *Alerter) AddChannel(channel Channel) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    this.channels = append(this.channels, channel)
+}
+
+// Emit keeps the alert in the recent list and sends it to all channels
+func (this *Alerter) Emit(alert *Alert) {
+    this.mutex.Lock()
+    this.recent = append(this.recent, alert)
+    if len(this.recent) > recentLimit {
+        this.recent = append(make([]*Alert, 0, recentLimit), this.recent[len(this.recent) - recentLimit:]...)
+    }
+    channels := this.channels
+    this.mutex.Unlock()
+
+    for i := range channels {
+        err := channels[i].SendAlert(alert)
+        if err != nil {
+            pmlog.LogError("unable send alert", alert.Id, "error:", err)
+        }
+    }
+}
+
+// Recent returns up to limit last alerts, newest first
+func (this *Alerter) Recent(limit int) []*Alert {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+
+    if limit <= 0 || limit > len(this.recent) {
+        limit = len(this.recent)
+    }
+    result := make([]*Alert, 0, limit)
+    for i := len(this.recent) - 1; i >= len(this.recent) - limit; i-- {
+        result = append(result, this.recent[i])
+    }
+    return result
+}
+
+//
+// LogChannel
+//
+type LogChannel struct {
+}
+
+func NewLogChannel() *LogChannel {
+    return &LogChannel{}
+}
+
+func (this *LogChannel) SendAlert(alert *Alert) error {
+    var err error
+    switch alert.Level {
+        case LevelInfo:
+            pmlog.LogInfo("alert", alert.Source, alert.Subject, alert.Message)
+        case LevelWarning:
+            pmlog.LogWarning("alert", alert.Source, alert.Subject, alert.Message)
+        default:
+            pmlog.LogError("alert", alert.Source, alert.Subject, alert.Message)
+    }
+    return err
+}
+//EOF
@@ -0,0 +1,276 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmbattery
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "sort"
+    "sync"
+    "time"
+
+    "app/pmalert"
+    "app/pmdrivers"
+    "app/pmtools"
+)
+
+const (
+    alertSource     string = "battery"
+
+    sampleInterval  time.Duration = 10 * time.Minute
+    maxPoints       int = 1008      // one week of samples
+    minTrendSpan    float64 = 1.0 / 24   // days
+    restoreMargin   int = 5         // percent
+    replaceJump     int = 20        // percent
+
+    fileMode        os.FileMode = 0640
+)
+
+//
+// Battery
+//
+type Point struct {
+    Time        time.Time   `json:"time"`
+    Level       int         `json:"level"`
+}
+
+type Battery struct {
+    Mac         string      `json:"mac"`
+    GatewayMac  string      `json:"gatewayMac"`
+    DriverId    string      `json:"driverId"`
+    Group       string      `json:"group,omitempty"`
+    Level       int         `json:"level"`
+    UpdatedAt   time.Time   `json:"updatedAt"`
+    Slope       float64     `json:"slope"`     // percent per day
+    DaysLeft    float64     `json:"daysLeft"`  // negative if unknown
+    Threshold   int         `json:"threshold"`
+    Low         bool        `json:"low"`
+    Draining    bool        `json:"draining"`
+    Points      []Point     `json:"points,omitempty"`
+}
+
+func NewBattery(mac string) *Battery {
+    var battery Battery
+    battery.Mac       = mac
+    battery.DaysLeft  = -1
+    battery.Points    = make([]Point, 0)
+    return &battery
+}
+
+func (this *Battery) addPoint(at time.Time, level int) {
+    count := len(this.Points)
+    if count > 0 && level - this.Points[count - 1].Level >= replaceJump {
+        this.Points = make([]Point, 0)
+        count = 0
+    }
+    if count > 0 && at.Sub(this.Points[count - 1].Time) < sampleInterval {
+        return
+    }
+    this.Points = append(this.Points, Point{ Time: at, Level: level })
+    if len(this.Points) > maxPoints {
+        this.Points = append(make([]Point, 0, maxPoints), this.Points[len(this.Points) - maxPoints:]...)
+    }
+    this.estimate()
+}
+
+// estimate fits a line to the points by least squares and
+// derives the expected days until the battery is empty
+func (this *Battery) estimate() {
+    this.Slope    = 0
+    this.DaysLeft = -1
+
+    count := len(this.Points)
+    if count < 2 {
+        return
+    }
+    origin := this.Points[0].Time
+    span := this.Points[count - 1].Time.Sub(origin).Hours() / 24
+    if span < minTrendSpan {
+        return
+    }
+
+    var sumX, sumY, sumXX, sumXY float64
+    for i := range this.Points {
+        x := this.Points[i].Time.Sub(origin).Hours() / 24
+        y := float64(this.Points[i].Level)
+        sumX  += x
+        sumY  += y
+        sumXX += x * x
+        sumXY += x * y
+    }
+    n := float64(count)
+    denom := n * sumXX - sumX * sumX
+    if denom == 0 {
+        return
+    }
+    this.Slope = (n * sumXY - sumX * sumY) / denom
+    if this.Slope < 0 {
+        this.DaysLeft = float64(this.Level) / -this.Slope
+    }
+}
+
+//
+// Monitor
+//
+type Monitor struct {
+    fileName            string
+    threshold           int
+    minDaysLeft         float64
+    groupThresholds     map[string]int
+    driverThresholds    map[string]int
+    groupOf             func(beacon *pmdrivers.IBeacon) string
+
+    alerter             *pmalert.Alerter
+    batteries           map[string]*Battery
+    mutex               sync.RWMutex
+}
+
+func NewMonitor(fileName string, threshold int, minDaysLeft float64, alerter *pmalert.Alerter) *Monitor {
+    var monitor Monitor
+    monitor.fileName         = fileName
+    monitor.threshold        = threshold
+    monitor.minDaysLeft      = minDaysLeft
+    monitor.alerter          = alerter
+    monitor.groupThresholds  = make(map[string]int)
+    monitor.driverThresholds = make(map[string]int)
+    monitor.batteries        = make(map[string]*Battery)
+    return &monitor
+}
+
+func (this *Monitor) SetDriverThreshold(driverId string, threshold int) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    this.driverThresholds[driverId] = threshold
+}
+
+func (this *Monitor) SetGroupThreshold(group string, threshold int) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    this.groupThresholds[group] = threshold
+}
+
+// SetGroupResolver sets the function used to find the tag group
+// of a beacon for per-group thresholds
+func (this *Monitor) SetGroupResolver(groupOf func(beacon *pmdrivers.IBeacon) string) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    this.groupOf = groupOf
+}
+
+func (this *Monitor) thresholdOf(driverId string, group string) int {
+    if threshold, exists := this.groupThresholds[group]; exists && len(group) > 0 {
+        return threshold
+    }
+    if threshold, exists := this.driverThresholds[driverId]; exists {
+        return threshold
+    }
+    return this.threshold
+}
+
+func (this *Monitor) HandleBeacon(driverId string, gatewayMac string, beacon *pmdrivers.IBeacon) {
+    if beacon.Battery <= 0 {
+        return
+    }
+    at := beacon.ReceivedAt
+    if at.IsZero() {
+        at = time.Now()
+    }
+    alerts := make([]*pmalert.Alert, 0)
+
+    this.mutex.Lock()
+    battery, exists := this.batteries[beacon.Mac]
+    if !exists {
+        battery = NewBattery(beacon.Mac)
+        this.batteries[beacon.Mac] = battery
+    }
+    if this.groupOf != nil {
+        battery.Group = this.groupOf(beacon)
+    }
+    battery.GatewayMac  = gatewayMac
+    battery.DriverId    = driverId
+    battery.Level       = beacon.Battery
+    battery.UpdatedAt   = at
+    battery.Threshold   = this.thresholdOf(driverId, battery.Group)
+    battery.addPoint(at, beacon.Battery)
+
+    switch {
+        case !battery.Low && battery.Level <= battery.Threshold:
+            battery.Low = true
+            message := fmt.Sprintf("battery level %d%% is at or below %d%%", battery.Level, battery.Threshold)
+            alerts = append(alerts, pmalert.NewAlert(pmalert.LevelWarning, alertSource, driverId, battery.Mac, message))
+        case battery.Low && battery.Level > battery.Threshold + restoreMargin:
+            battery.Low = false
+            message := fmt.Sprintf("battery level %d%% is restored", battery.Level)
+            alerts = append(alerts, pmalert.NewAlert(pmalert.LevelInfo, alertSource, driverId, battery.Mac, message))
+    }
+    draining := battery.DaysLeft >= 0 && battery.DaysLeft < this.minDaysLeft
+    if draining && !battery.Draining {
+        message := fmt.Sprintf("battery is expected to run out in %.1f days", battery.DaysLeft)
+        alerts = append(alerts, pmalert.NewAlert(pmalert.LevelWarning, alertSource, driverId, battery.Mac, message))
+    }
+    battery.Draining = draining
+    this.mutex.Unlock()
+
+    for i := range alerts {
+        this.alerter.Emit(alerts[i])
+    }
+}
+
+// Report returns all batteries sorted by level, lowest first
+func (this *Monitor) Report() []*Battery {
+    this.mutex.RLock()
+    result := make([]*Battery, 0, len(this.batteries))
+    for _, battery := range this.batteries {
+        item := *battery
+        item.Points = nil
+        result = append(result, &item)
+    }
+    this.mutex.RUnlock()
+
+    sort.Slice(result, func(i, j int) bool {
+        if result[i].Level != result[j].Level {
+            return result[i].Level < result[j].Level
+        }
+        return result[i].Mac < result[j].Mac
+    })
+    return result
+}
+
+func (this *Monitor) Save() error {
+    var err error
+
+    this.mutex.RLock()
+    data, err := json.Marshal(this.batteries)
+    this.mutex.RUnlock()
+    if err != nil {
+        return err
+    }
+    return pmtools.WriteFileAtomic(this.fileName, data, fileMode)
+}
+
+func (this *Monitor) Load() error {
+    var err error
+
+    data, err := ioutil.ReadFile(this.fileName)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    batteries := make(map[string]*Battery)
+    err = json.Unmarshal(data, &batteries)
+    if err != nil {
+        return err
+    }
+
+    this.mutex.Lock()
+    this.batteries = batteries
+    this.mutex.Unlock()
+    return err
+}
+//EOF
@@ -0,0 +1,101 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmconfig
+
+type DriverChange string
+
+const (
+    DriverAdded         DriverChange = "added"
+    DriverRemoved       DriverChange = "removed"
+    DriverReplaced      DriverChange = "replaced"
+    DriverReconfigured  DriverChange = "reconfigured"
+    DriverUnchanged     DriverChange = "unchanged"
+)
+
+// DriverDiff describes the change of the driver definition,
+// Current is nil for added drivers and Next for removed ones
+type DriverDiff struct {
+    Name        string
+    Change      DriverChange
+    Current     *DriverConfig
+    Next        *DriverConfig
+}
+
+// DiffDrivers compares enabled driver definitions by name,
+// a disabled driver is treated as removed
+func DiffDrivers(current, next []DriverConfig) []DriverDiff {
+    result := make([]DriverDiff, 0)
+    currentDefs := enabledDrivers(current)
+    nextDefs := enabledDrivers(next)
+
+    for i := range next {
+        name := next[i].Name
+        nextDef, enabled := nextDefs[name]
+        if !enabled {
+            continue
+        }
+        currentDef, exists := currentDefs[name]
+        diff := DriverDiff{ Name: name, Current: currentDef, Next: nextDef }
+        switch {
+            case !exists:
+                diff.Change = DriverAdded
+            case currentDef.Class != nextDef.Class:
+                diff.Change = DriverReplaced
+            case !equalConfigs(currentDef.Configs, nextDef.Configs) ||
+                        !equalSubjects(currentDef.Subjects, nextDef.Subjects):
+                diff.Change = DriverReconfigured
+            default:
+                diff.Change = DriverUnchanged
+        }
+        result = append(result, diff)
+    }
+    for i := range current {
+        name := current[i].Name
+        currentDef, enabled := currentDefs[name]
+        if !enabled {
+            continue
+        }
+        if _, exists := nextDefs[name]; !exists {
+            result = append(result, DriverDiff{ Name: name, Change: DriverRemoved, Current: currentDef })
+        }
+    }
+    return result
+}
+
+func enabledDrivers(defs []DriverConfig) map[string]*DriverConfig {
+    result := make(map[string]*DriverConfig)
+    for i := range defs {
+        if defs[i].Enabled {
+            result[defs[i].Name] = &defs[i]
+        }
+    }
+    return result
+}
+
+func equalConfigs(a, b map[string]string) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for name, value := range a {
+        other, exists := b[name]
+        if !exists || other != value {
+            return false
+        }
+    }
+    return true
+}
+
+func equalSubjects(a, b []SubjectConfig) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+//EOF
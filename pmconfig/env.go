@@ -0,0 +1,242 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmconfig
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "reflect"
+    "strconv"
+    "strings"
+
+    "app/pmlog"
+    "app/pmtools"
+)
+
+//
+// Environment overrides
+//
+// Config fields are overridden by PMAPP_<KEY>_<KEY>... variables,
+// keys are yaml keys in upper case, e.g. PMAPP_WEBCONFIG_PORT.
+// Driver config values are overridden by PMAPP_DRIVER_<NAME>_<CONFIG>,
+// e.g. PMAPP_DRIVER_MG1_AC233FC0025F_MQTTURL, non alphanumeric
+// characters of names are replaced by underscore.
+// Lists are given comma separated, e.g. PMAPP_LOGSINKS=file,journald,
+// maps as key=value pairs, e.g. PMAPP_LOGLEVELS=mqtt=debug,drivers=warning.
+const (
+    envPrefix       string = "PMAPP_"
+    envDriverPrefix string = envPrefix + "DRIVER_"
+    EnvConfigPath   string = envPrefix + "CONFIG"
+
+    fileRefPrefix   string = "file:"
+    envRefPrefix    string = "env:"
+)
+
+// EnvName makes the variable name part of the key
+func EnvName(key string) string {
+    var builder strings.Builder
+    for _, char := range strings.ToUpper(key) {
+        if (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9') {
+            builder.WriteRune(char)
+            continue
+        }
+        builder.WriteRune('_')
+    }
+    return builder.String()
+}
+
+func (this *Config) ApplyEnv() error {
+    var err error
+    err = applyEnvFields(reflect.ValueOf(this).Elem(), envPrefix)
+    if err != nil {
+        return err
+    }
+    this.applyDriverEnv()
+    return err
+}
+
+func applyEnvFields(value reflect.Value, prefix string) error {
+    var err error
+    valueType := value.Type()
+    for i := 0; i < valueType.NumField(); i++ {
+        field := valueType.Field(i)
+        key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+        if key == "-" || len(field.PkgPath) > 0 {
+            continue
+        }
+        if len(key) == 0 {
+            key = field.Name
+        }
+        name := prefix + EnvName(key)
+        fieldValue := value.Field(i)
+        if fieldValue.Kind() == reflect.Struct {
+            err = applyEnvFields(fieldValue, name + "_")
+            if err != nil {
+                return err
+            }
+            continue
+        }
+        envValue, exists := os.LookupEnv(name)
+        if !exists {
+            continue
+        }
+        err = setFieldValue(fieldValue, envValue)
+        if err != nil {
+            return fmt.Errorf("wrong %s value: %s", name, err)
+        }
+    }
+    return err
+}
+
+func setFieldValue(value reflect.Value, text string) error {
+    switch value.Kind() {
+        case reflect.Slice:
+            items := splitList(text)
+            list := reflect.MakeSlice(value.Type(), len(items), len(items))
+            for i, item := range items {
+                err := setFieldValue(list.Index(i), item)
+                if err != nil {
+                    return err
+                }
+            }
+            value.Set(list)
+            return nil
+        case reflect.Map:
+            if value.Type().Key().Kind() != reflect.String {
+                return fmt.Errorf("type %s is not supported", value.Type())
+            }
+            items := reflect.MakeMap(value.Type())
+            for _, item := range splitList(text) {
+                pair := strings.SplitN(item, "=", 2)
+                if len(pair) != 2 || len(strings.TrimSpace(pair[0])) == 0 {
+                    return fmt.Errorf("%q is not key=value pair", item)
+                }
+                element := reflect.New(value.Type().Elem()).Elem()
+                err := setFieldValue(element, strings.TrimSpace(pair[1]))
+                if err != nil {
+                    return err
+                }
+                items.SetMapIndex(reflect.ValueOf(strings.TrimSpace(pair[0])), element)
+            }
+            value.Set(items)
+            return nil
+    }
+    switch value.Kind() {
+        case reflect.String:
+            value.SetString(text)
+        case reflect.Int:
+            number, err := strconv.Atoi(text)
+            if err != nil {
+                return err
+            }
+            value.SetInt(int64(number))
+        case reflect.Float64:
+            number, err := strconv.ParseFloat(text, 64)
+            if err != nil {
+                return err
+            }
+            value.SetFloat(number)
+        case reflect.Bool:
+            flag, err := strconv.ParseBool(text)
+            if err != nil {
+                return err
+            }
+            value.SetBool(flag)
+        default:
+            return fmt.Errorf("type %s is not supported", value.Type())
+    }
+    return nil
+}
+
+// splitList splits comma separated items, empty items are skipped
+func splitList(text string) []string {
+    result := make([]string, 0)
+    for _, item := range strings.Split(text, ",") {
+        item = strings.TrimSpace(item)
+        if len(item) > 0 {
+            result = append(result, item)
+        }
+    }
+    return result
+}
+
+// applyDriverEnv sets driver config values, the variable is
+// given to the driver with the longest matching name
+func (this *Config) applyDriverEnv() {
+    for _, item := range os.Environ() {
+        pair := strings.SplitN(item, "=", 2)
+        if len(pair) != 2 || !strings.HasPrefix(pair[0], envDriverPrefix) {
+            continue
+        }
+        rest := strings.TrimPrefix(pair[0], envDriverPrefix)
+
+        var def *DriverConfig
+        var configKey string
+        for i := range this.Drivers {
+            prefix := EnvName(this.Drivers[i].Name) + "_"
+            if !strings.HasPrefix(rest, prefix) || len(rest) == len(prefix) {
+                continue
+            }
+            if def == nil || len(prefix) > len(EnvName(def.Name)) + 1 {
+                def = &this.Drivers[i]
+                configKey = strings.TrimPrefix(rest, prefix)
+            }
+        }
+        if def == nil {
+            pmlog.LogWarning("variable", pair[0], "does not match any driver")
+            continue
+        }
+        if def.Configs == nil {
+            def.Configs = make(map[string]string)
+        }
+        name := configKey
+        for key := range def.Configs {
+            if EnvName(key) == configKey {
+                name = key
+            }
+        }
+        def.Configs[name] = pair[1]
+    }
+}
+
+//
+// Secret references
+//
+// IsReference tells file: and env: secret references
+func IsReference(value string) bool {
+    return strings.HasPrefix(value, fileRefPrefix) || strings.HasPrefix(value, envRefPrefix)
+}
+
+func maskSecret(value string) string {
+    if len(value) == 0 || IsReference(value) {
+        return value
+    }
+    return pmtools.SecretMask
+}
+
+// ResolveValue returns the content of "file:<path>" or the variable
+// of "env:<name>" reference, other values are returned as is
+func ResolveValue(value string) (string, error) {
+    switch {
+        case strings.HasPrefix(value, fileRefPrefix):
+            fileName := strings.TrimPrefix(value, fileRefPrefix)
+            data, err := ioutil.ReadFile(fileName)
+            if err != nil {
+                return "", fmt.Errorf("unable read secret: %s", err)
+            }
+            return strings.TrimRight(string(data), "\r\n"), nil
+        case strings.HasPrefix(value, envRefPrefix):
+            name := strings.TrimPrefix(value, envRefPrefix)
+            envValue, exists := os.LookupEnv(name)
+            if !exists {
+                return "", fmt.Errorf("secret variable %s is not set", name)
+            }
+            return envValue, nil
+    }
+    return value, nil
+}
+
+//EOF
@@ -0,0 +1,247 @@
+package pmconfig
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+
+    "app/pmtools"
+)
+
+// setEnv sets variables and returns the function restoring them
+func setEnv(t *testing.T, vars map[string]string) func() {
+    t.Helper()
+    saved := make(map[string]*string)
+    for name, value := range vars {
+        if previous, exists := os.LookupEnv(name); exists {
+            saved[name] = &previous
+        } else {
+            saved[name] = nil
+        }
+        os.Setenv(name, value)
+    }
+    return func() {
+        for name, previous := range saved {
+            if previous == nil {
+                os.Unsetenv(name)
+                continue
+            }
+            os.Setenv(name, *previous)
+        }
+    }
+}
+
+func TestEnvName(t *testing.T) {
+    tests := map[string]string{
+        "webConfig":            "WEBCONFIG",
+        "mg1-ac233fc0025f":     "MG1_AC233FC0025F",
+        "MqttUrl":              "MQTTURL",
+        "a.b c":                "A_B_C",
+    }
+    for key, want := range tests {
+        if got := EnvName(key); got != want {
+            t.Errorf("%q: got %s, expected %s", key, got, want)
+        }
+    }
+}
+
+func TestSetFieldValue(t *testing.T) {
+    var target struct {
+        Text        string
+        Number      int
+        Ratio       float64
+        Flag        bool
+        List        []string
+        Numbers     []int
+        Levels      map[string]string
+        Limits      map[string]int
+        ByNumber    map[int]string
+    }
+    tests := []struct {
+        field       string
+        text        string
+        want        interface{}
+        wantErr     string
+    }{
+        { field: "Text",    text: "a,b",    want: "a,b" },
+        { field: "Number",  text: "42",     want: 42 },
+        { field: "Number",  text: "4x",     wantErr: "invalid syntax" },
+        { field: "Ratio",   text: "0.5",    want: 0.5 },
+        { field: "Flag",    text: "true",   want: true },
+        { field: "Flag",    text: "yes",    wantErr: "invalid syntax" },
+        { field: "List",    text: "file, journald,,syslog", want: []string{ "file", "journald", "syslog" } },
+        { field: "List",    text: "",       want: []string{} },
+        { field: "Numbers", text: "1,2,3",  want: []int{ 1, 2, 3 } },
+        { field: "Numbers", text: "1,two",  wantErr: "invalid syntax" },
+        { field: "Levels",  text: "mqtt=debug, drivers = warning", want: map[string]string{ "mqtt": "debug", "drivers": "warning" } },
+        { field: "Levels",  text: "url=mqtt://host?a=b", want: map[string]string{ "url": "mqtt://host?a=b" } },
+        { field: "Levels",  text: "mqtt=",  want: map[string]string{ "mqtt": "" } },
+        { field: "Levels",  text: "mqtt",   wantErr: `"mqtt" is not key=value pair` },
+        { field: "Levels",  text: "=debug", wantErr: `"=debug" is not key=value pair` },
+        { field: "Levels",  text: "mqtt=debug,drivers", wantErr: `"drivers" is not key=value pair` },
+        { field: "Limits",  text: "a=1,b=2", want: map[string]int{ "a": 1, "b": 2 } },
+        { field: "Limits",  text: "a=low",  wantErr: "invalid syntax" },
+        { field: "ByNumber", text: "1=a",   wantErr: "is not supported" },
+    }
+    for _, test := range tests {
+        value := reflect.ValueOf(&target).Elem().FieldByName(test.field)
+        err := setFieldValue(value, test.text)
+        if len(test.wantErr) > 0 {
+            if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+                t.Errorf("%s %q: got error %v, expected %q", test.field, test.text, err, test.wantErr)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("%s %q: unexpected error %s", test.field, test.text, err)
+            continue
+        }
+        if !reflect.DeepEqual(value.Interface(), test.want) {
+            t.Errorf("%s %q: got %#v, expected %#v", test.field, test.text, value.Interface(), test.want)
+        }
+    }
+}
+
+func TestApplyEnv(t *testing.T) {
+    restore := setEnv(t, map[string]string{
+        "PMAPP_WEBCONFIG_PORT":         "9090",
+        "PMAPP_DBCONFIG_PASSWORD":      "env:DB_SECRET",
+        "PMAPP_LOGSINKS":               "file,journald",
+        "PMAPP_LOGLEVELS":              "mqtt=debug,drivers=warning",
+        "PMAPP_LOGROTATION_COMPRESS":   "true",
+    })
+    defer restore()
+
+    config := NewConfig()
+    err := config.ApplyEnv()
+    if err != nil {
+        t.Fatalf("unexpected error %s", err)
+    }
+    if config.WebConfig.Port != 9090 {
+        t.Errorf("got port %d", config.WebConfig.Port)
+    }
+    if config.DbConfig.Password != "env:DB_SECRET" {
+        t.Errorf("got password %q, the reference is resolved later", config.DbConfig.Password)
+    }
+    if !reflect.DeepEqual(config.LogSinks, []string{ "file", "journald" }) {
+        t.Errorf("got sinks %v", config.LogSinks)
+    }
+    if !reflect.DeepEqual(config.LogLevels, map[string]string{ "mqtt": "debug", "drivers": "warning" }) {
+        t.Errorf("got levels %v", config.LogLevels)
+    }
+    if !config.LogRotation.Compress {
+        t.Errorf("compress is not set")
+    }
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+    tests := map[string]string{
+        "PMAPP_WEBCONFIG_PORT":     "http",
+        "PMAPP_LOGLEVELS":          "mqtt=debug,drivers",
+        "PMAPP_LOGROTATION_COMPRESS": "sometimes",
+    }
+    for name, value := range tests {
+        restore := setEnv(t, map[string]string{ name: value })
+        err := NewConfig().ApplyEnv()
+        restore()
+        if err == nil || !strings.Contains(err.Error(), name) {
+            t.Errorf("%s=%s: got error %v, expected error naming the variable", name, value, err)
+        }
+    }
+}
+
+func TestApplyDriverEnv(t *testing.T) {
+    restore := setEnv(t, map[string]string{
+        "PMAPP_DRIVER_MG1_AC233FC0025F_MQTTURL":    "mqtt://broker:1883",
+        "PMAPP_DRIVER_MG1_FILTERMODE":              "registered",
+        "PMAPP_DRIVER_UNKNOWN_MQTTURL":             "mqtt://other:1883",
+        "PMAPP_DRIVER_MG1_":                        "empty config name",
+    })
+    defer restore()
+
+    config := NewConfig()
+    config.Drivers = []DriverConfig{
+        DriverConfig{ Name: "mg1", Class: "MG1" },
+        DriverConfig{ Name: "mg1-ac233fc0025f", Class: "MG1",
+                        Configs: map[string]string{ "MqttUrl": "mqtt://localhost:1883" } },
+    }
+    err := config.ApplyEnv()
+    if err != nil {
+        t.Fatalf("unexpected error %s", err)
+    }
+    // the longest driver name wins, the existing config key is kept
+    want := map[string]string{ "MqttUrl": "mqtt://broker:1883" }
+    if !reflect.DeepEqual(config.Drivers[1].Configs, want) {
+        t.Errorf("got %v, expected %v", config.Drivers[1].Configs, want)
+    }
+    want = map[string]string{ "FILTERMODE": "registered" }
+    if !reflect.DeepEqual(config.Drivers[0].Configs, want) {
+        t.Errorf("got %v, expected %v", config.Drivers[0].Configs, want)
+    }
+    for i := range config.Drivers {
+        for name, value := range config.Drivers[i].Configs {
+            if value == "mqtt://other:1883" || value == "empty config name" {
+                t.Errorf("driver %s got %s=%s of unknown driver", config.Drivers[i].Name, name, value)
+            }
+        }
+    }
+}
+
+func TestResolveValue(t *testing.T) {
+    dir, err := ioutil.TempDir("", "pmconfig")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    fileName := filepath.Join(dir, "secret")
+    err = ioutil.WriteFile(fileName, []byte("from file\n"), 0600)
+    if err != nil {
+        t.Fatal(err)
+    }
+    restore := setEnv(t, map[string]string{ "PMAPP_TEST_SECRET": "from env" })
+    defer restore()
+    os.Unsetenv("PMAPP_TEST_MISSING")
+
+    tests := []struct {
+        value       string
+        want        string
+        wantErr     bool
+    }{
+        { value: "plain",                       want: "plain" },
+        { value: "",                            want: "" },
+        { value: "file:" + fileName,            want: "from file" },
+        { value: "file:" + fileName + ".none",  wantErr: true },
+        { value: "env:PMAPP_TEST_SECRET",       want: "from env" },
+        { value: "env:PMAPP_TEST_MISSING",      wantErr: true },
+    }
+    for _, test := range tests {
+        got, err := ResolveValue(test.value)
+        if test.wantErr {
+            if err == nil {
+                t.Errorf("%q: expected error", test.value)
+            }
+            continue
+        }
+        if err != nil || got != test.want {
+            t.Errorf("%q: got %q, %v, expected %q", test.value, got, err, test.want)
+        }
+    }
+}
+
+func TestMaskSecret(t *testing.T) {
+    tests := map[string]string{
+        "":                 "",
+        "s3cret":           pmtools.SecretMask,
+        "env:DB_SECRET":    "env:DB_SECRET",
+        "file:/etc/secret": "file:/etc/secret",
+    }
+    for value, want := range tests {
+        if got := maskSecret(value); got != want {
+            t.Errorf("%q: got %q, expected %q", value, got, want)
+        }
+    }
+}
+//EOF
@@ -10,21 +10,53 @@ import (
     "io/ioutil"
     "path/filepath"
     "encoding/json"
+    "errors"
     "os"
+    "strconv"
+    "strings"
 
     "github.com/go-yaml/yaml"
+
+    "app/pmlog"
+)
+
+const (
+    CommandRun          string = "run"
+    CommandCheckConfig  string = "check-config"
+    CommandPrintConfig  string = "print-config"
+    CommandInitConfig   string = "init-config"
+
+    FormatYaml          string = "yaml"
+    FormatJson          string = "json"
 )
 
 type Config struct {
-    DataDir             string  `yaml:"datadir"`
-    PidPath             string  `yaml:"pidfile"`
-    MessageLogPath      string  `yaml:"messagelog"`
-    AccessLogPath       string  `yaml:"accesslog"`
-    ConfigPath          string  `yaml:"-"`
-    LibDir              string  `yaml:"-"`
+    DataDir             string  `yaml:"datadir"     json:"datadir"`
+    PidPath             string  `yaml:"pidfile"     json:"pidfile"`
+    MessageLogPath      string  `yaml:"messagelog"  json:"messagelog"`
+    AccessLogPath       string  `yaml:"accesslog"   json:"accesslog"`
+    ConfigPath          string  `yaml:"-"           json:"-"`
+    LibDir              string  `yaml:"-"           json:"-"`
+    LogLevel            string  `yaml:"loglevel"    json:"loglevel"`
+    LogFormat           string  `yaml:"logformat"   json:"logformat"`  // text or json
+    LogLevels           map[string]string `yaml:"loglevels" json:"loglevels"`  // level by component
+    LogSinks            []string `yaml:"logsinks"    json:"logsinks"`    // file, syslog, journald
+    LogBufferSize       int     `yaml:"logbuffer"   json:"logbuffer"`  // records kept for the api, 0 disables
+    User                string  `yaml:"user"        json:"user"`       // run as user when started by root, empty keeps root
+    Group               string  `yaml:"group"       json:"group"`
+
+    Options         Options         `yaml:"-"               json:"-"`
+
+    LogRotation     LogRotation     `yaml:"logRotation"     json:"logRotation"`
+
+    DbConfig        DbConfig        `yaml:"dbConfig"        json:"dbConfig"`
+    WebConfig       WebConfig       `yaml:"webConfig"       json:"webConfig"`
+    HistoryConfig   HistoryConfig   `yaml:"historyConfig"   json:"historyConfig"`
+    BatteryConfig   BatteryConfig   `yaml:"batteryConfig"   json:"batteryConfig"`
+    TagConfig       TagConfig       `yaml:"tagConfig"       json:"tagConfig"`
+    DiscoveryConfig DiscoveryConfig `yaml:"discoveryConfig" json:"discoveryConfig"`
 
-    DbConfig    DbConfig    `yaml:"dbConfig"    json:"dbConfig"`
-    WebConfig   WebConfig   `yaml:"webConfig"   json:"webConfig"`
+    Drivers         []DriverConfig  `yaml:"drivers"         json:"drivers"`
 }
 
 type ProcConfig struct {
@@ -37,8 +69,82 @@ type ProcConfig struct {
 
 }
 
+// Options are the command line options, Flags keeps explicitly
+// given flags overriding values of the config file
+type Options struct {
+    Command     string
+    Format      string
+    Foreground  bool
+    Systemd     bool
+    Flags       map[string]string
+}
+
+// HasLogSink reports the sink is selected
+func (this *Config) HasLogSink(name string) bool {
+    for _, sink := range this.LogSinks {
+        if sink == name {
+            return true
+        }
+    }
+    return false
+}
+
+// LogRotation applies to the message and access logs,
+// zero values disable the rotation by size or by time
+type LogRotation struct {
+    MaxSize     int         `yaml:"maxsize"     json:"maxsize"`     // MiB
+    Period      int         `yaml:"period"      json:"period"`      // hours
+    Keep        int         `yaml:"keep"        json:"keep"`        // rotated files
+    Compress    bool        `yaml:"compress"    json:"compress"`
+}
+
+// WebConfig.Token authorizes API calls changing the state
+// and reading logs as "Authorization: Bearer <token>", the log
+// tail websocket takes it as the access_token parameter too.
+// It may be a file: or env: reference.
 type WebConfig struct {
-    Port        int         `yaml:"hostname"    json:"hostname"`
+    Port        int         `yaml:"port"        json:"port"`
+    Token       string      `yaml:"token"       json:"token"`
+}
+
+// HistoryConfig.Dir keeps daily segment files of beacon samples,
+// samples of passed minutes are appended every SavePeriod
+type HistoryConfig struct {
+    Dir         string      `yaml:"dir"         json:"dir"`
+    Retention   int         `yaml:"retention"   json:"retention"`   // hours
+    SavePeriod  int         `yaml:"saveperiod"  json:"saveperiod"`  // sec
+}
+
+type BatteryConfig struct {
+    FileName    string          `yaml:"filename"    json:"filename"`
+    LowLevel    int             `yaml:"lowlevel"    json:"lowlevel"`     // percent
+    MinDaysLeft float64         `yaml:"mindaysleft" json:"mindaysleft"`
+    GroupLevels map[string]int  `yaml:"grouplevels" json:"grouplevels"`  // percent by tag group
+}
+
+type TagConfig struct {
+    FileName    string      `yaml:"filename"    json:"filename"`
+}
+
+type DiscoveryConfig struct {
+    FileName    string      `yaml:"filename"    json:"filename"`
+}
+
+// DriverConfig defines a driver instance by its class,
+// config values by name and subjects
+type DriverConfig struct {
+    Name        string              `yaml:"name"        json:"name"`
+    Class       string              `yaml:"class"       json:"class"`
+    Enabled     bool                `yaml:"enabled"     json:"enabled"`
+    Configs     map[string]string   `yaml:"configs"     json:"configs"`
+    Subjects    []SubjectConfig     `yaml:"subjects"    json:"subjects"`
+}
+
+type SubjectConfig struct {
+    Name        string      `yaml:"name"        json:"name"`
+    Topic       string      `yaml:"topic"       json:"topic"`
+    Codec       string      `yaml:"codec"       json:"codec"`
+    Enabled     bool        `yaml:"enabled"     json:"enabled"`
 }
 
 type DbConfig struct {
@@ -50,6 +156,12 @@ type DbConfig struct {
 }
 
 func NewConfig() *Config {
+    logRotation := LogRotation{
+        MaxSize:    100,
+        Period:     24,
+        Keep:       7,
+        Compress:   true,
+    }
     webConfig := WebConfig{
         Port:       8090,
     }
@@ -57,8 +169,51 @@ func NewConfig() *Config {
         Hostname:   "localhost",
         Port:       5432,
         Username:   "pgsql",
-        Password:   "qwert",
-    } 
+    }
+    historyConfig := HistoryConfig{
+        Dir:        "history",
+        Retention:  24 * 7,
+        SavePeriod: 300,
+    }
+    batteryConfig := BatteryConfig{
+        FileName:    "battery.json",
+        LowLevel:    20,
+        MinDaysLeft: 14,
+        GroupLevels: make(map[string]int),
+    }
+    tagConfig := TagConfig{
+        FileName:   "tags.json",
+    }
+    discoveryConfig := DiscoveryConfig{
+        FileName:   "discovery.json",
+    }
+    drivers := []DriverConfig{
+        DriverConfig{
+            Name:       "mg1-ac233fc0025f",
+            Class:      "MG1",
+            Enabled:    true,
+            Configs:    map[string]string{
+                "MqttUrl":  "mqtt://v7.unix7.org:1883",
+            },
+            Subjects:   []SubjectConfig{
+                SubjectConfig{
+                    Name:       "StatusTopic",
+                    Topic:      "/gw/ac233fc0025f/status",
+                    Codec:      "json",
+                    Enabled:    true,
+                },
+            },
+        },
+        DriverConfig{
+            Name:       "mg1-discovery",
+            Class:      "MG1Discovery",
+            Enabled:    false,
+            Configs:    map[string]string{
+                "MqttUrl":          "mqtt://v7.unix7.org:1883",
+                "ApprovalRequired": "true",
+            },
+        },
+    }
     return &Config{
         ConfigPath:     "/usr/local/etc/pmapp/pmapp.yml",
         LibDir:         "/usr/local/share/pmapp",
@@ -67,10 +222,43 @@ func NewConfig() *Config {
         PidPath:        "/var/run/pmapp/pmapp.pid",
         MessageLogPath: "/var/log/pmapp/message.log",
         AccessLogPath:  "/var/log/pmapp/access.log",
+        LogLevel:       "info",
+        LogFormat:      "text",
+        LogLevels:      make(map[string]string),
+        LogSinks:       []string{ pmlog.SinkFile },
+        LogBufferSize:  pmlog.DefaultBufferSize,
+        User:           "",
+        Group:          "",
+
+        LogRotation:    logRotation,
+        DbConfig:       dbConfig,
+        WebConfig:      webConfig,
+        HistoryConfig:  historyConfig,
+        BatteryConfig:  batteryConfig,
+        TagConfig:      tagConfig,
+        DiscoveryConfig: discoveryConfig,
+        Drivers:        drivers,
+    }
+}
 
-        DbConfig:   dbConfig,
-        WebConfig:  webConfig,
+// Masked returns the copy of the config with secret values masked,
+// file: and env: references are kept as they disclose nothing
+func (this *Config) Masked(isSecret func(class, name string) bool) *Config {
+    config := *this
+    config.DbConfig.Password = maskSecret(this.DbConfig.Password)
+    config.WebConfig.Token = maskSecret(this.WebConfig.Token)
+    config.Drivers = make([]DriverConfig, len(this.Drivers))
+    for i, def := range this.Drivers {
+        def.Configs = make(map[string]string)
+        for name, value := range this.Drivers[i].Configs {
+            if isSecret(def.Class, name) {
+                value = maskSecret(value)
+            }
+            def.Configs[name] = value
+        }
+        config.Drivers[i] = def
     }
+    return &config
 }
 
 func (this *Config) Json() string {
@@ -107,38 +295,265 @@ func (this *Config) Read(fileName string) error {
     return yaml.Unmarshal(data, &this)
 }
 
+// Setup parses the command line "command [option]", the
+// default command is run
 func (this *Config) Setup() error {
-    var err error
-    flag.StringVar(&this.DbConfig.Hostname, "host", this.DbConfig.Hostname, "database hostname")
-    flag.IntVar(&this.DbConfig.Port, "port", this.DbConfig.Port, "database port")
-    flag.StringVar(&this.DbConfig.Username, "user", this.DbConfig.Username, "database username")
-    flag.StringVar(&this.DbConfig.Password, "pass", this.DbConfig.Password, "database password")
-    flag.StringVar(&this.DbConfig.Database, "data", this.DbConfig.Database, "database name")
+    if configPath, exists := os.LookupEnv(EnvConfigPath); exists {
+        this.ConfigPath = configPath
+    }
+    flag.StringVar(&this.ConfigPath, "config", this.ConfigPath, "config file path")
+    flag.String("loglevel", this.LogLevel, "log level: debug, info, warning, error")
+    flag.String("logformat", this.LogFormat, "log format: text, json")
+    flag.Int("listen", this.WebConfig.Port, "web server listen port")
+    flag.StringVar(&this.Options.Format, "format", FormatYaml, "print-config format: yaml, json")
+    flag.BoolVar(&this.Options.Foreground, "foreground", false, "run in foreground, do not detach from terminal")
+    flag.BoolVar(&this.Options.Systemd, "systemd", false, "run as systemd notify service, implied by NOTIFY_SOCKET")
+    flag.String("pidfile", this.PidPath, "pid file path")
+    flag.String("messagelog", this.MessageLogPath, "message log file path")
+    flag.String("runuser", this.User, "run as user when started by root")
+    flag.String("rungroup", this.Group, "run as group when started by root")
+
+    flag.String("host", this.DbConfig.Hostname, "database hostname")
+    flag.Int("port", this.DbConfig.Port, "database port")
+    flag.String("user", this.DbConfig.Username, "database username")
+    flag.String("data", this.DbConfig.Database, "database name")
 
     exeName := filepath.Base(os.Args[0])
 
     flag.Usage = func() {
         fmt.Println(exeName)
         fmt.Println("")
-        fmt.Printf("usage: %s command [option]\n", exeName)
+        fmt.Printf("usage: %s [option] command\n", exeName)
+        fmt.Println("")
+        fmt.Println("commands:")
+        fmt.Printf("  %-14s run the application (default)\n", CommandRun)
+        fmt.Printf("  %-14s validate the config file and exit\n", CommandCheckConfig)
+        fmt.Printf("  %-14s print the effective config and exit\n", CommandPrintConfig)
+        fmt.Printf("  %-14s write the default config file and exit\n", CommandInitConfig)
         fmt.Println("")
+        fmt.Println("options:")
         flag.PrintDefaults()
         fmt.Println("")
     }
     flag.Parse()
+
+    this.Options.Flags = make(map[string]string)
+    flag.Visit(func(item *flag.Flag) {
+        this.Options.Flags[item.Name] = item.Value.String()
+    })
+
+    this.Options.Command = CommandRun
+    switch flag.NArg() {
+        case 0:
+        case 1:
+            this.Options.Command = flag.Arg(0)
+        default:
+            return fmt.Errorf("too many arguments: %s", strings.Join(flag.Args(), " "))
+    }
+    switch this.Options.Command {
+        case CommandRun, CommandCheckConfig, CommandPrintConfig, CommandInitConfig:
+        default:
+            return fmt.Errorf("unknown command %q", this.Options.Command)
+    }
+    switch this.Options.Format {
+        case FormatYaml, FormatJson:
+        default:
+            return fmt.Errorf("unknown format %q", this.Options.Format)
+    }
+    return this.ApplyFlags()
+}
+
+// ApplyFlags overrides config values by explicitly given flags,
+// it is called again after the config file is read
+func (this *Config) ApplyFlags() error {
+    var err error
+    for name, value := range this.Options.Flags {
+        switch name {
+            case "loglevel":
+                this.LogLevel = value
+            case "logformat":
+                this.LogFormat = value
+            case "pidfile":
+                this.PidPath = value
+            case "messagelog":
+                this.MessageLogPath = value
+            case "runuser":
+                this.User = value
+            case "rungroup":
+                this.Group = value
+            case "listen":
+                this.WebConfig.Port, err = strconv.Atoi(value)
+            case "host":
+                this.DbConfig.Hostname = value
+            case "port":
+                this.DbConfig.Port, err = strconv.Atoi(value)
+            case "user":
+                this.DbConfig.Username = value
+            case "data":
+                this.DbConfig.Database = value
+        }
+        if err != nil {
+            return fmt.Errorf("wrong flag %s value: %s", name, err)
+        }
+    }
     return err
 }
 
-func (this *Config) GetDbURL() string {
+// Load reads the config file over defaults and applies environment
+// variables and flags, a missing file is not an error unless required
+func (this *Config) Load(required bool) error {
+    var err error
+    err = this.Read(this.ConfigPath)
+    if os.IsNotExist(err) && !required {
+        pmlog.LogWarning("config file", this.ConfigPath, "not found, defaults are used")
+        err = nil
+    }
+    if err != nil {
+        return fmt.Errorf("unable read config %s: %s", this.ConfigPath, err)
+    }
+    err = this.ApplyEnv()
+    if err != nil {
+        return err
+    }
+    err = this.ApplyFlags()
+    if err != nil {
+        return err
+    }
+    return this.Validate()
+}
+
+// Validate checks values and reports all found problems at once
+func (this *Config) Validate() error {
+    problems := make([]string, 0)
+    addProblem := func(format string, args ...interface{}) {
+        problems = append(problems, fmt.Sprintf(format, args...))
+    }
+
+    if len(this.DataDir) == 0 {
+        addProblem("datadir is empty")
+    }
+    if len(this.PidPath) == 0 {
+        addProblem("pidfile is empty")
+    }
+    if len(this.MessageLogPath) == 0 {
+        addProblem("messagelog is empty")
+    }
+    if _, err := ResolveValue(this.DbConfig.Password); err != nil {
+        addProblem("dbConfig.password: %s", err)
+    }
+    if _, err := pmlog.ParseLevel(this.LogLevel); err != nil {
+        addProblem("loglevel: %s", err)
+    }
+    if _, err := pmlog.ParseFormat(this.LogFormat); err != nil {
+        addProblem("logformat: %s", err)
+    }
+    for component, level := range this.LogLevels {
+        if _, err := pmlog.ParseLevel(level); err != nil {
+            addProblem("loglevels.%s: %s", component, err)
+        }
+    }
+    for _, sink := range this.LogSinks {
+        if _, err := pmlog.ParseSink(sink); err != nil {
+            addProblem("logsinks: %s", err)
+        }
+    }
+    if this.LogBufferSize < 0 {
+        addProblem("logbuffer must not be negative")
+    }
+    if this.LogRotation.MaxSize < 0 || this.LogRotation.Period < 0 {
+        addProblem("logRotation.maxsize and logRotation.period must not be negative")
+    }
+    if this.LogRotation.Keep < 1 {
+        addProblem("logRotation.keep must be positive")
+    }
+    if this.WebConfig.Port < 1 || this.WebConfig.Port > 65535 {
+        addProblem("webConfig.port %d out of range", this.WebConfig.Port)
+    }
+    if _, err := ResolveValue(this.WebConfig.Token); err != nil {
+        addProblem("webConfig.token: %s", err)
+    }
+    if len(this.HistoryConfig.Dir) == 0 {
+        addProblem("historyConfig.dir is empty")
+    }
+    if this.HistoryConfig.Retention < 1 {
+        addProblem("historyConfig.retention must be positive")
+    }
+    if this.HistoryConfig.SavePeriod < 1 {
+        addProblem("historyConfig.saveperiod must be positive")
+    }
+    if this.BatteryConfig.LowLevel < 0 || this.BatteryConfig.LowLevel > 100 {
+        addProblem("batteryConfig.lowlevel %d out of range", this.BatteryConfig.LowLevel)
+    }
+    for group, level := range this.BatteryConfig.GroupLevels {
+        if level < 0 || level > 100 {
+            addProblem("batteryConfig.grouplevels %s: %d out of range", group, level)
+        }
+    }
+
+    names := make(map[string]bool)
+    for i := range this.Drivers {
+        def := &this.Drivers[i]
+        if len(def.Name) == 0 {
+            addProblem("drivers[%d]: empty name", i)
+        }
+        if names[def.Name] {
+            addProblem("drivers[%d]: duplicate name %q", i, def.Name)
+        }
+        names[def.Name] = true
+        if len(def.Class) == 0 {
+            addProblem("driver %s: empty class", def.Name)
+        }
+        for name, value := range def.Configs {
+            if _, err := ResolveValue(value); err != nil {
+                addProblem("driver %s: config %s: %s", def.Name, name, err)
+            }
+        }
+        subjects := make(map[string]bool)
+        for j := range def.Subjects {
+            subject := &def.Subjects[j]
+            if len(subject.Name) == 0 {
+                addProblem("driver %s: subjects[%d]: empty name", def.Name, j)
+            }
+            if subjects[subject.Name] {
+                addProblem("driver %s: duplicate subject %q", def.Name, subject.Name)
+            }
+            subjects[subject.Name] = true
+            if len(subject.Topic) == 0 {
+                addProblem("driver %s: subject %s: empty topic", def.Name, subject.Name)
+            }
+        }
+    }
+    if len(problems) > 0 {
+        return errors.New(strings.Join(problems, "; "))
+    }
+    return nil
+}
+
+func (this *Config) GetDbURL() (string, error) {
+    password, err := ResolveValue(this.DbConfig.Password)
+    if err != nil {
+        return "", err
+    }
     return fmt.Sprintf("postgres://%s:%s@%s:%d/%s",
                 this.DbConfig.Username,
-                this.DbConfig.Password,
+                password,
                 this.DbConfig.Hostname,
                 this.DbConfig.Port,
-                this.DbConfig.Database)
+                this.DbConfig.Database), err
+}
+
+func (this *Config) GetApiToken() (string, error) {
+    return ResolveValue(this.WebConfig.Token)
 }
 
 func (this *Config) GetListenParam() string {
     return fmt.Sprintf(":%d", this.WebConfig.Port)
 }
+
+func (this *Config) GetDataPath(fileName string) string {
+    if filepath.IsAbs(fileName) {
+        return fileName
+    }
+    return filepath.Join(this.DataDir, fileName)
+}
 //EOF
@@ -9,77 +9,114 @@ import (
     "fmt"
     "io/fs"
     "io"
+    "io/ioutil"
     "log"
     "os"
     "os/signal"
-    "os/user"
     "path/filepath"
     "strconv"
+    "strings"
     "syscall"
     "time"
 
+    "app/pmlog"
 )
 
 type Daemon struct {
     username        string
+    groupname       string
+    ownedDirs       []string
+    ownedFiles      []string
     logFilename     string
+    logRotation     pmlog.RotateConfig
+    logFile         *pmlog.RotatingFile
+    noLogFile       bool
     pidFilename     string
     debug           bool
     foreground      bool
+    pidFile         *os.File
 }
 
 const (
     piddirMode  fs.FileMode = 0750
     pidfileMode fs.FileMode = 0640
 
-    logdirMode  fs.FileMode = 0750
     logfileMode fs.FileMode = 0640
+
+    forkEnvName string = "GOGOFORK"
 )
 
 func NewDaemon(logFilename, pidFilename string, debug, foreground bool) *Daemon {
-    curUser, _ := user.Current()
-    username := curUser.Username
     return &Daemon{
-        username:           username,
-        logFilename:        logFilename,     
+        logFilename:        logFilename,
         pidFilename:        pidFilename,
         debug:              debug,
         foreground:         foreground,
+        ownedDirs:          make([]string, 0),
+        ownedFiles:         make([]string, 0),
     }
 }
 
+// SetLogRotation sets the rotation of the message log
+func (this *Daemon) SetLogRotation(config pmlog.RotateConfig) {
+    this.logRotation = config
+}
+
+// DisableLogFile keeps the log off the message file when
+// other log sinks like syslog or journald are used
+func (this *Daemon) DisableLogFile() {
+    this.noLogFile = true
+}
+
+// SetUser sets the user and the group to run as, the empty
+// group means the primary group of the user
+func (this *Daemon) SetUser(username, groupname string) {
+    this.username = username
+    this.groupname = groupname
+}
+
+// AddOwnedDir adds the directory given to the user on
+// privilege dropping, e.g. the data directory
+func (this *Daemon) AddOwnedDir(dirname string) {
+    this.ownedDirs = append(this.ownedDirs, dirname)
+}
+
+// AddOwnedFile adds the file, e.g. the access log, given to
+// the user with its directory on privilege dropping
+func (this *Daemon) AddOwnedFile(filename string) {
+    this.ownedFiles = append(this.ownedFiles, filename)
+}
+
+// Daemonize forks the process unless it runs in foreground and
+// writes the locked pidfile, the start is refused while other
+// instance holds the pidfile lock
 func (this *Daemon) Daemonize() error {
     var err error
 
-    if !this.foreground{
-        forkProcess()
+    if !this.foreground {
+        if !isForked() {
+            err = checkProcessID(this.pidFilename)
+            if err != nil {
+                return err
+            }
+        }
+        // the parent exits here, the child starts new session
+        err = forkProcess()
+        if err != nil {
+            return fmt.Errorf("unable fork process: %s", err)
+        }
     }
 
-    err = saveProcessID(this.pidFilename, piddirMode, pidfileMode)
+    this.pidFile, err = saveProcessID(this.pidFilename, piddirMode, pidfileMode)
     if err != nil {
-        return errors.New(fmt.Sprintf("unable save process id: %s\n", err))
+        return fmt.Errorf("unable save process id: %s", err)
     }
 
-    user, err := user.Lookup(this.username)
-    if err != nil {
-        return errors.New(fmt.Sprintf("user lookup error: %s\n", err))
-    }
-    uid, err := strconv.Atoi(user.Uid)
-
-    /* Change effective user ID */
-    //if uid != 0 {
-    //    err = syscall.Setuid(uid)
-    //    if err != nil {
-    //        return errors.New(fmt.Sprintf("set process user id error: %s\n", err))
-    //    }
-    //    if syscall.Getuid() != uid {
-    //        return errors.New(fmt.Sprintf("set process user id error: %s\n", err))
-    //    }
-    //}
-
-    _, err = redirectLog(uid, this.logFilename, logdirMode, logfileMode, false)
-    if err != nil {
-        return errors.New(fmt.Sprintf("unable redirect log to message file: %s\n", err))
+    if !this.noLogFile {
+        this.logFile, err = redirectLog(this.logFilename, logfileMode, this.logRotation, false)
+        if err != nil {
+            return errors.New(fmt.Sprintf("unable redirect log to message file: %s\n", err))
+        }
     }
 
     if !this.foreground {
@@ -91,11 +128,43 @@ func (this *Daemon) Daemonize() error {
     return nil
 }
 
-func SetSignalHandler() {
+// ReopenLog opens the message log again after external rotation
+func (this *Daemon) ReopenLog() error {
+    if this.logFile == nil {
+        return nil
+    }
+    return this.logFile.Reopen()
+}
+
+// Release unlocks and removes the pidfile written by the process
+func (this *Daemon) Release() error {
+    var err error
+    if this.pidFile == nil {
+        return err
+    }
+    err = os.Remove(this.pidFilename)
+    this.pidFile.Close()
+    this.pidFile = nil
+    return err
+}
+
+// SignalHandlers are called by the signal handler, a nil
+// handler keeps the default action of the signal
+type SignalHandlers struct {
+    Stop    func()
+    Reload  func()
+    Reopen  func()
+}
+
+// SetSignalHandler calls the stop handler once, the next stop
+// signal during shutdown exits the process at once
+func SetSignalHandler(handlers SignalHandlers) {
     sigs := make(chan os.Signal, 1)
-    signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGSTOP, syscall.SIGTERM, syscall.SIGQUIT)
+    signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGSTOP, syscall.SIGTERM, syscall.SIGQUIT,
+                        syscall.SIGUSR1)
 
     go func() {
+        stopping := false
         for {
             log.Printf("signal handler start")
             sig := <- sigs
@@ -103,52 +172,95 @@ func SetSignalHandler() {
 
             switch sig {
                 case syscall.SIGINT, syscall.SIGTERM, syscall.SIGSTOP:
-                    log.Printf("exit process by signal %s", sig.String())
-                    time.Sleep(time.Millisecond * 100)
-                    os.Exit(0)
+                    if stopping {
+                        log.Printf("force exit process by signal %s", sig.String())
+                        os.Exit(1)
+                    }
+                    if handlers.Stop == nil {
+                        log.Printf("exit process by signal %s", sig.String())
+                        time.Sleep(time.Millisecond * 100)
+                        os.Exit(0)
+                    }
+                    log.Printf("stop process by signal %s", sig.String())
+                    stopping = true
+                    go handlers.Stop()
 
                 case syscall.SIGHUP:
-                    log.Printf("restart program")
-                    forkProcess()
+                    if handlers.Reload == nil {
+                        log.Printf("restart program")
+                        forkProcess()
+                        continue
+                    }
+                    go handlers.Reload()
+
+                case syscall.SIGUSR1:
+                    if handlers.Reopen == nil {
+                        continue
+                    }
+                    go handlers.Reopen()
             }
         }
     }()
 }
 
-func saveProcessID(filename string, piddirMode fs.FileMode, pidfileMode fs.FileMode) error {
+// saveProcessID keeps the pidfile open, the lock is held
+// until the file is closed or the process exits
+func saveProcessID(filename string, piddirMode fs.FileMode, pidfileMode fs.FileMode) (*os.File, error) {
     var err error
 
     err = os.MkdirAll(filepath.Dir(filename), piddirMode)
     if err != nil {
-        return errors.New(fmt.Sprintf("unable create rundir: %s\n", err))
+        return nil, fmt.Errorf("unable create rundir: %s", err)
     }
-    pid := os.Getpid()
     file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, pidfileMode)
     if err != nil {
-         return err
+        return nil, err
     }
-    defer file.Close()
-    _, err = file.WriteString(strconv.Itoa(pid))
+    err = lockProcessID(file)
     if err != nil {
-        return err
+        file.Close()
+        return nil, err
+    }
+    err = file.Truncate(0)
+    if err != nil {
+        file.Close()
+        return nil, err
+    }
+    _, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid()) + "\n"), 0)
+    if err != nil {
+        file.Close()
+        return nil, err
     }
     file.Sync()
-    return nil
+    return file, nil
 }
 
-func redirectLog(uid int, filename string, logdirMode fs.FileMode, logfileMode fs.FileMode, shortFile bool) (*os.File, error) {
-    var err error
-    
-    err = os.MkdirAll(filepath.Dir(filename), logdirMode)
+// checkProcessID refuses the start before fork, so the error
+// is reported to the terminal
+func checkProcessID(filename string) error {
+    file, err := os.OpenFile(filename, os.O_RDONLY, 0)
     if err != nil {
-        return nil, err
+        return nil
+    }
+    defer file.Close()
+    return lockProcessID(file)
+}
+
+func lockProcessID(file *os.File) error {
+    err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+    if err == syscall.EWOULDBLOCK {
+        data, _ := ioutil.ReadFile(file.Name())
+        return fmt.Errorf("other instance is running, pid %s locks %s",
+                        strings.TrimSpace(string(data)), file.Name())
     }
-    err = os.Chown(filepath.Dir(filename), uid, os.Getgid())
     if err != nil {
-        return nil, err
+        return fmt.Errorf("unable lock %s: %s", file.Name(), err)
     }
+    return err
+}
 
-    file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, logfileMode)
+func redirectLog(filename string, logfileMode fs.FileMode, rotation pmlog.RotateConfig, shortFile bool) (*pmlog.RotatingFile, error) {
+    file, err := pmlog.OpenRotatingFile(filename, logfileMode, rotation)
     if err != nil {
         return nil, err
     }
@@ -174,9 +286,14 @@ func redirectIO() (*os.File, error) {
     return file, nil
 }
 
+func isForked() bool {
+    _, exists := os.LookupEnv(forkEnvName)
+    return exists
+}
+
 func forkProcess() error {
-    if _, exists := os.LookupEnv("GOGOFORK"); !exists {
-        os.Setenv("GOGOFORK", "yes")
+    if !isForked() {
+        os.Setenv(forkEnvName, "yes")
 
         cwd, err := os.Getwd()
         if err != nil {
@@ -187,7 +304,15 @@ func forkProcess() error {
         procAttr.Files = []uintptr{ uintptr(syscall.Stdin), uintptr(syscall.Stdout), uintptr(syscall.Stderr) }
         procAttr.Env = os.Environ()
         procAttr.Dir = cwd
-        syscall.ForkExec(os.Args[0], os.Args, &procAttr)
+        // os.Args[0] may be found by PATH
+        exePath, err := os.Executable()
+        if err != nil {
+            return err
+        }
+        _, err = syscall.ForkExec(exePath, os.Args, &procAttr)
+        if err != nil {
+            return err
+        }
         os.Exit(0)
     }
     _, err := syscall.Setsid()
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2019 Oleg Borodin  <borodin@unix7.org>
+ */
+
+package pmdaemon
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "os/user"
+    "path/filepath"
+    "strconv"
+    "syscall"
+)
+
+const (
+    parentDirMode   os.FileMode = 0755
+    ownedDirMode    os.FileMode = 0750
+)
+
+// DropPrivileges switches the process started by root to the
+// configured user, group and supplementary groups of the user.
+// Before the switch the pid, log and owned files, their not shared
+// directories and owned directories are given to the user.
+// A process started by other user keeps its credentials.
+func (this *Daemon) DropPrivileges() error {
+    var err error
+
+    if os.Getuid() != 0 {
+        if len(this.username) > 0 {
+            current, _ := user.Current()
+            if current == nil || current.Username != this.username {
+                log.Printf("not started by root, keep running as uid %d", os.Getuid())
+            }
+        }
+        return err
+    }
+    if len(this.username) == 0 || this.username == "root" {
+        log.Printf("warning: running as root, set the user to drop privileges")
+        return err
+    }
+
+    uid, gid, groups, err := lookupCredential(this.username, this.groupname)
+    if err != nil {
+        return err
+    }
+
+    files := []string{ this.pidFilename }
+    if !this.noLogFile {
+        files = append(files, this.logFilename)
+    }
+    files = append(files, this.ownedFiles...)
+    dirs := make([]string, 0, len(files))
+    for _, filename := range files {
+        dirs = append(dirs, filepath.Dir(filename))
+    }
+    for _, filename := range files {
+        err = os.Chown(filename, uid, gid)
+        if err != nil && !os.IsNotExist(err) {
+            return fmt.Errorf("unable chown %s: %s", filename, err)
+        }
+    }
+    for _, dirname := range dirs {
+        if isSharedDir(dirname) {
+            continue
+        }
+        err = os.Chown(dirname, uid, gid)
+        if err != nil {
+            return fmt.Errorf("unable chown %s: %s", dirname, err)
+        }
+    }
+    for _, dirname := range this.ownedDirs {
+        err = makeOwnedDir(dirname)
+        if err != nil {
+            return fmt.Errorf("unable create %s: %s", dirname, err)
+        }
+        err = chownTree(dirname, uid, gid)
+        if err != nil {
+            return fmt.Errorf("unable chown %s: %s", dirname, err)
+        }
+    }
+
+    err = syscall.Setgroups(groups)
+    if err != nil {
+        return fmt.Errorf("unable set groups: %s", err)
+    }
+    err = syscall.Setgid(gid)
+    if err != nil {
+        return fmt.Errorf("unable set group id %d: %s", gid, err)
+    }
+    err = syscall.Setuid(uid)
+    if err != nil {
+        return fmt.Errorf("unable set user id %d: %s", uid, err)
+    }
+    if os.Getuid() != uid || os.Geteuid() != uid || os.Getgid() != gid {
+        return fmt.Errorf("user id %d is not applied", uid)
+    }
+    log.Printf("running as user %s, uid %d, gid %d", this.username, uid, gid)
+    return err
+}
+
+// lookupCredential returns ids of the user, the group and
+// supplementary groups of the user
+func lookupCredential(username, groupname string) (int, int, []int, error) {
+    var err error
+    var uid, gid int
+    groups := make([]int, 0)
+
+    runUser, err := user.Lookup(username)
+    if err != nil {
+        return uid, gid, groups, fmt.Errorf("user lookup error: %s", err)
+    }
+    uid, err = strconv.Atoi(runUser.Uid)
+    if err != nil {
+        return uid, gid, groups, fmt.Errorf("wrong uid of user %s: %s", username, err)
+    }
+    groupId := runUser.Gid
+    if len(groupname) > 0 {
+        var runGroup *user.Group
+        runGroup, err = user.LookupGroup(groupname)
+        if err != nil {
+            return uid, gid, groups, fmt.Errorf("group lookup error: %s", err)
+        }
+        groupId = runGroup.Gid
+    }
+    gid, err = strconv.Atoi(groupId)
+    if err != nil {
+        return uid, gid, groups, fmt.Errorf("wrong gid of group %s: %s", groupId, err)
+    }
+
+    groupIds, err := runUser.GroupIds()
+    if err != nil {
+        return uid, gid, groups, fmt.Errorf("groups lookup error: %s", err)
+    }
+    groups = append(groups, gid)
+    for _, item := range groupIds {
+        var id int
+        id, err = strconv.Atoi(item)
+        if err != nil || id == gid {
+            continue
+        }
+        groups = append(groups, id)
+    }
+    return uid, gid, groups, nil
+}
+
+// isSharedDir protects common directories like /var/run
+// or /tmp when the pid or log file is placed directly there
+func isSharedDir(dirname string) bool {
+    info, err := os.Stat(dirname)
+    if err != nil {
+        return true
+    }
+    if info.Mode() & os.ModeSticky != 0 {
+        return true
+    }
+    switch filepath.Clean(dirname) {
+        case "/", "/tmp", "/run", "/var/run", "/var/log", "/var/tmp":
+            return true
+    }
+    return false
+}
+
+// makeOwnedDir keeps created parent directories
+// accessible for the user
+func makeOwnedDir(dirname string) error {
+    err := os.MkdirAll(filepath.Dir(dirname), parentDirMode)
+    if err != nil {
+        return err
+    }
+    err = os.Mkdir(dirname, ownedDirMode)
+    if err != nil && !os.IsExist(err) {
+        return err
+    }
+    return nil
+}
+
+func chownTree(dirname string, uid, gid int) error {
+    return filepath.Walk(dirname, func(path string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        return os.Lchown(path, uid, gid)
+    })
+}
+//EOF
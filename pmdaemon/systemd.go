@@ -0,0 +1,132 @@
+/*
+ * Copyright 2019 Oleg Borodin  <borodin@unix7.org>
+ */
+
+package pmdaemon
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+)
+
+//
+// systemd service protocol, see sd_notify(3), sd_watchdog_enabled(3)
+// and sd_listen_fds(3)
+//
+const (
+    NotifyReady     string = "READY=1"
+    NotifyReloading string = "RELOADING=1"
+    NotifyStopping  string = "STOPPING=1"
+    NotifyWatchdog  string = "WATCHDOG=1"
+
+    notifySocketEnv string = "NOTIFY_SOCKET"
+    watchdogUsecEnv string = "WATCHDOG_USEC"
+    watchdogPidEnv  string = "WATCHDOG_PID"
+    listenPidEnv    string = "LISTEN_PID"
+    listenFdsEnv    string = "LISTEN_FDS"
+
+    listenFdsStart  int = 3
+)
+
+// NotifyEnabled reports the service manager waits for
+// notifications, e.g. the systemd unit has Type=notify
+func NotifyEnabled() bool {
+    return len(os.Getenv(notifySocketEnv)) > 0
+}
+
+// Notify sends the state to the service manager, false is
+// returned when the process is not started with notify access
+func Notify(state string) (bool, error) {
+    socketName := os.Getenv(notifySocketEnv)
+    if len(socketName) == 0 {
+        return false, nil
+    }
+    // the abstract socket name starts with zero byte
+    if strings.HasPrefix(socketName, "@") {
+        socketName = "\x00" + socketName[1:]
+    }
+    addr := &net.UnixAddr{ Name: socketName, Net: "unixgram" }
+    conn, err := net.DialUnix("unixgram", nil, addr)
+    if err != nil {
+        return false, err
+    }
+    defer conn.Close()
+    _, err = conn.Write([]byte(state))
+    if err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+// NotifyStatus sends the free form status line
+func NotifyStatus(status string) (bool, error) {
+    status = strings.ReplaceAll(status, "\n", " ")
+    return Notify("STATUS=" + status)
+}
+
+// WatchdogInterval returns the watchdog timeout of the service,
+// zero means the watchdog is disabled. The process has to ping
+// the manager at least twice per the interval.
+func WatchdogInterval() (time.Duration, error) {
+    var interval time.Duration
+    usecValue := os.Getenv(watchdogUsecEnv)
+    if len(usecValue) == 0 {
+        return interval, nil
+    }
+    usec, err := strconv.ParseInt(usecValue, 10, 64)
+    if err != nil || usec <= 0 {
+        return interval, fmt.Errorf("wrong %s value %q", watchdogUsecEnv, usecValue)
+    }
+    pidValue := os.Getenv(watchdogPidEnv)
+    if len(pidValue) > 0 {
+        pid, err := strconv.Atoi(pidValue)
+        if err != nil {
+            return interval, fmt.Errorf("wrong %s value %q", watchdogPidEnv, pidValue)
+        }
+        if pid != os.Getpid() {
+            return interval, nil
+        }
+    }
+    interval = time.Duration(usec) * time.Microsecond
+    return interval, nil
+}
+
+// ActivationListeners returns listeners passed by socket
+// activation, the variables are unset so child processes
+// do not take the sockets
+func ActivationListeners() ([]net.Listener, error) {
+    listeners := make([]net.Listener, 0)
+    pidValue := os.Getenv(listenPidEnv)
+    fdsValue := os.Getenv(listenFdsEnv)
+    if len(pidValue) == 0 || len(fdsValue) == 0 {
+        return listeners, nil
+    }
+    defer os.Unsetenv(listenPidEnv)
+    defer os.Unsetenv(listenFdsEnv)
+
+    pid, err := strconv.Atoi(pidValue)
+    if err != nil || pid != os.Getpid() {
+        return listeners, nil
+    }
+    count, err := strconv.Atoi(fdsValue)
+    if err != nil || count < 0 {
+        return listeners, fmt.Errorf("wrong %s value %q", listenFdsEnv, fdsValue)
+    }
+    for fd := listenFdsStart; fd < listenFdsStart + count; fd++ {
+        syscall.CloseOnExec(fd)
+        file := os.NewFile(uintptr(fd), "listen-fd-" + strconv.Itoa(fd))
+        listener, err := net.FileListener(file)
+        file.Close()
+        if err != nil {
+            return listeners, fmt.Errorf("unable use socket fd %d: %s", fd, err)
+        }
+        listeners = append(listeners, listener)
+    }
+    return listeners, nil
+}
+//EOF
@@ -0,0 +1,286 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmdiscovery
+
+import (
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "os"
+    "sort"
+    "sync"
+    "time"
+
+    "app/pmlog"
+    "app/pmtools"
+)
+
+type Status string
+
+const (
+    StatusPending   Status = "pending"
+    StatusApproved  Status = "approved"
+    StatusRejected  Status = "rejected"
+
+    fileMode        os.FileMode = 0640
+)
+
+//
+// Candidate
+//
+// Candidate is a gateway seen by a discovery driver, approved
+// candidates are served by own driver created from the template.
+// The broker of the source driver is resolved when the driver is
+// created, so no credentials are kept in the registry file.
+type Candidate struct {
+    Mac         string      `json:"mac"`
+    Status      Status      `json:"status"`
+    Source      string      `json:"source"`       // discovery driver name
+    DriverId    string      `json:"driverId"`     // id of the serving driver
+    Topic       string      `json:"topic"`
+    Codec       string      `json:"codec"`
+    FirstSeen   time.Time   `json:"firstSeen"`
+    UpdatedAt   time.Time   `json:"updatedAt"`
+}
+
+// ApproveFunc creates the driver of the approved candidate
+type ApproveFunc = func(candidate *Candidate) error
+
+// RemoveFunc stops the driver of the removed or rejected
+// candidate, if any
+type RemoveFunc = func(candidate *Candidate) error
+
+//
+// Registry
+//
+type Registry struct {
+    fileName    string
+    candidates  map[string]*Candidate
+    onApprove   ApproveFunc
+    onRemove    RemoveFunc
+    mutex       sync.RWMutex
+}
+
+func NewRegistry(fileName string) *Registry {
+    var registry Registry
+    registry.fileName   = fileName
+    registry.candidates = make(map[string]*Candidate)
+    return &registry
+}
+
+func (this *Registry) SetApproveHandler(onApprove ApproveFunc) {
+    this.onApprove = onApprove
+}
+
+func (this *Registry) SetRemoveHandler(onRemove RemoveFunc) {
+    this.onRemove = onRemove
+}
+
+// Discover registers the gateway, it is approved at once unless
+// the approval is required. Known gateways are left as they are.
+func (this *Registry) Discover(candidate *Candidate, approvalRequired bool) error {
+    this.mutex.Lock()
+    if _, exists := this.candidates[candidate.Mac]; exists {
+        this.mutex.Unlock()
+        return nil
+    }
+    item := *candidate
+    item.Status     = StatusPending
+    item.FirstSeen  = time.Now()
+    item.UpdatedAt  = item.FirstSeen
+    this.candidates[item.Mac] = &item
+    this.mutex.Unlock()
+
+    if approvalRequired {
+        pmlog.LogInfo("gateway", item.Mac, "waits for approval")
+        return this.Save()
+    }
+    return this.Approve(item.Mac)
+}
+
+func (this *Registry) Approve(mac string) error {
+    var err error
+    this.mutex.Lock()
+    candidate, exists := this.candidates[mac]
+    if !exists {
+        this.mutex.Unlock()
+        return errors.New("gateway not found")
+    }
+    if candidate.Status == StatusApproved {
+        this.mutex.Unlock()
+        return nil
+    }
+    // the driver id is kept, so the gateway is served
+    // by the driver with the same id after restart
+    if len(candidate.DriverId) == 0 {
+        candidate.DriverId = pmtools.GetNewUUID()
+    }
+    item := *candidate
+    this.mutex.Unlock()
+
+    if this.onApprove != nil {
+        err = this.onApprove(&item)
+        if err != nil {
+            return err
+        }
+    }
+
+    this.mutex.Lock()
+    candidate.Status    = StatusApproved
+    candidate.UpdatedAt = time.Now()
+    this.mutex.Unlock()
+    pmlog.LogInfo("gateway", mac, "is approved")
+    return this.Save()
+}
+
+// Reject stops serving the approved gateway, the rejected
+// gateway is not approved again when it is seen
+func (this *Registry) Reject(mac string) error {
+    var err error
+    this.mutex.Lock()
+    candidate, exists := this.candidates[mac]
+    if !exists {
+        this.mutex.Unlock()
+        return errors.New("gateway not found")
+    }
+    item := *candidate
+    this.mutex.Unlock()
+
+    if item.Status == StatusApproved && this.onRemove != nil {
+        err = this.onRemove(&item)
+        if err != nil {
+            return err
+        }
+    }
+
+    this.mutex.Lock()
+    candidate.Status    = StatusRejected
+    candidate.UpdatedAt = time.Now()
+    this.mutex.Unlock()
+    pmlog.LogInfo("gateway", mac, "is rejected")
+    return this.Save()
+}
+
+// Remove stops serving the gateway and forgets it,
+// the gateway is discovered again when it is seen
+func (this *Registry) Remove(mac string) error {
+    var err error
+    this.mutex.Lock()
+    candidate, exists := this.candidates[mac]
+    if !exists {
+        this.mutex.Unlock()
+        return errors.New("gateway not found")
+    }
+    item := *candidate
+    this.mutex.Unlock()
+
+    if this.onRemove != nil {
+        err = this.onRemove(&item)
+        if err != nil {
+            return err
+        }
+    }
+
+    this.mutex.Lock()
+    delete(this.candidates, mac)
+    this.mutex.Unlock()
+    pmlog.LogInfo("gateway", mac, "is removed")
+    return this.Save()
+}
+
+// Approved returns candidates to serve at start
+func (this *Registry) Approved() []*Candidate {
+    result := make([]*Candidate, 0)
+    for _, candidate := range this.List() {
+        if candidate.Status == StatusApproved {
+            result = append(result, candidate)
+        }
+    }
+    return result
+}
+
+func (this *Registry) List() []*Candidate {
+    this.mutex.RLock()
+    result := make([]*Candidate, 0, len(this.candidates))
+    for _, candidate := range this.candidates {
+        item := *candidate
+        result = append(result, &item)
+    }
+    this.mutex.RUnlock()
+
+    sort.Slice(result, func(i, j int) bool {
+        return result[i].Mac < result[j].Mac
+    })
+    return result
+}
+
+// record reads files of previous versions, they kept the
+// mqtt url with credentials of the broker
+type record struct {
+    Candidate
+    MqttUrl     string      `json:"mqttUrl,omitempty"`
+}
+
+func (this *Registry) Save() error {
+    var err error
+
+    this.mutex.RLock()
+    records := make([]Candidate, 0, len(this.candidates))
+    for _, candidate := range this.candidates {
+        records = append(records, *candidate)
+    }
+    this.mutex.RUnlock()
+    sort.Slice(records, func(i, j int) bool {
+        return records[i].Mac < records[j].Mac
+    })
+
+    data, err := json.MarshalIndent(records, "", "    ")
+    if err != nil {
+        return err
+    }
+    return pmtools.WriteFileAtomic(this.fileName, data, fileMode)
+}
+
+func (this *Registry) Load() error {
+    var err error
+
+    data, err := ioutil.ReadFile(this.fileName)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    records := make([]record, 0)
+    err = json.Unmarshal(data, &records)
+    if err != nil {
+        return err
+    }
+
+    legacy := false
+    this.mutex.Lock()
+    this.candidates = make(map[string]*Candidate)
+    for i := range records {
+        candidate := records[i].Candidate
+        if candidate.Status == StatusApproved && len(candidate.DriverId) == 0 {
+            candidate.DriverId = pmtools.GetNewUUID()
+            legacy = true
+        }
+        if len(records[i].MqttUrl) > 0 {
+            legacy = true
+        }
+        this.candidates[candidate.Mac] = &candidate
+    }
+    this.mutex.Unlock()
+
+    // the file is written again without broker credentials
+    // and with driver ids of approved gateways
+    if legacy {
+        pmlog.LogInfo("upgrade discovered gateways file", this.fileName)
+        return this.Save()
+    }
+    return err
+}
+//EOF
@@ -0,0 +1,158 @@
+
+package pmdrivers
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "reflect"
+
+    "github.com/ugorji/go/codec"
+)
+
+//
+// Codec
+//
+const (
+    CodecJson       string = "json"
+    CodecMsgpack    string = "msgpack"
+    CodecRaw        string = "raw"
+)
+
+// Codec decodes subject payloads into driver models
+type Codec interface {
+    Name() string
+    Decode(payload []byte, value interface{}) error
+}
+
+// ArrayCodec splits array payloads into encoded elements,
+// so elements are decoded and rejected one by one
+type ArrayCodec interface {
+    Codec
+    SplitArray(payload []byte) ([][]byte, error)
+}
+
+func GetCodec(name string) (Codec, error) {
+    switch name {
+        case CodecJson, "":
+            return NewJsonCodec(), nil
+        case CodecMsgpack:
+            return NewMsgpackCodec(), nil
+        case CodecRaw:
+            return NewRawCodec(), nil
+    }
+    return nil, fmt.Errorf("unknown codec %q", name)
+}
+
+//
+// JsonCodec
+//
+type JsonCodec struct {
+}
+
+func NewJsonCodec() *JsonCodec {
+    return &JsonCodec{}
+}
+
+func (this *JsonCodec) Name() string {
+    return CodecJson
+}
+
+func (this *JsonCodec) Decode(payload []byte, value interface{}) error {
+    return json.Unmarshal(payload, value)
+}
+
+func (this *JsonCodec) SplitArray(payload []byte) ([][]byte, error) {
+    elements := make([]json.RawMessage, 0)
+    err := json.Unmarshal(payload, &elements)
+    if err != nil {
+        return nil, err
+    }
+    result := make([][]byte, len(elements))
+    for i := range elements {
+        result[i] = elements[i]
+    }
+    return result, err
+}
+
+//
+// MsgpackCodec
+//
+// MsgpackCodec decodes MessagePack directly into the value,
+// fields are matched by json tags, so models need no separate
+// msgpack tags
+type MsgpackCodec struct {
+    handle  *codec.MsgpackHandle
+}
+
+func NewMsgpackCodec() *MsgpackCodec {
+    var handle codec.MsgpackHandle
+    handle.RawToString  = true
+    handle.WriteExt     = true
+    handle.MapType      = reflect.TypeOf(map[string]interface{}(nil))
+    handle.TypeInfos    = codec.NewTypeInfos([]string{ "codec", "json" })
+    return &MsgpackCodec{ handle: &handle }
+}
+
+func (this *MsgpackCodec) Name() string {
+    return CodecMsgpack
+}
+
+func (this *MsgpackCodec) Decode(payload []byte, value interface{}) error {
+    return codec.NewDecoderBytes(payload, this.handle).Decode(value)
+}
+
+// SplitArray accepts array payloads only, the decoder
+// would split a map into its keys and values
+func (this *MsgpackCodec) SplitArray(payload []byte) ([][]byte, error) {
+    if !isMsgpackArray(payload) {
+        return nil, errors.New("msgpack payload is not array")
+    }
+    elements := make([]codec.Raw, 0)
+    err := codec.NewDecoderBytes(payload, this.handle).Decode(&elements)
+    if err != nil {
+        return nil, err
+    }
+    result := make([][]byte, len(elements))
+    for i := range elements {
+        result[i] = elements[i]
+    }
+    return result, err
+}
+
+// isMsgpackArray checks the format byte is fixarray, array 16 or array 32
+func isMsgpackArray(payload []byte) bool {
+    if len(payload) == 0 {
+        return false
+    }
+    format := payload[0]
+    return format & 0xf0 == 0x90 || format == 0xdc || format == 0xdd
+}
+
+//
+// RawCodec
+//
+// RawCodec passes the payload through untouched
+type RawCodec struct {
+}
+
+func NewRawCodec() *RawCodec {
+    return &RawCodec{}
+}
+
+func (this *RawCodec) Name() string {
+    return CodecRaw
+}
+
+func (this *RawCodec) Decode(payload []byte, value interface{}) error {
+    switch target := value.(type) {
+        case *[]byte:
+            *target = append((*target)[:0], payload...)
+            return nil
+        case *json.RawMessage:
+            *target = append((*target)[:0], payload...)
+            return nil
+    }
+    return errors.New("raw codec decodes only into byte slice")
+}
+//EOF
@@ -0,0 +1,150 @@
+package pmdrivers
+
+import (
+    "encoding/json"
+    "testing"
+
+    "github.com/ugorji/go/codec"
+)
+
+// encodePayload encodes the value the way gateways send it
+func encodePayload(t *testing.T, codecName string, value interface{}) []byte {
+    t.Helper()
+    var payload []byte
+    var err error
+    switch codecName {
+        case CodecJson:
+            payload, err = json.Marshal(value)
+        case CodecMsgpack:
+            var handle codec.MsgpackHandle
+            handle.WriteExt = true
+            err = codec.NewEncoderBytes(&payload, &handle).Encode(value)
+        default:
+            t.Fatalf("unexpected codec %q", codecName)
+    }
+    if err != nil {
+        t.Fatalf("unable encode %s payload: %s", codecName, err)
+    }
+    return payload
+}
+
+func TestGetCodec(t *testing.T) {
+    tests := []struct {
+        name        string
+        want        string
+        wantErr     bool
+    }{
+        { name: "",         want: CodecJson },
+        { name: "json",     want: CodecJson },
+        { name: "msgpack",  want: CodecMsgpack },
+        { name: "raw",      want: CodecRaw },
+        { name: "xml",      wantErr: true },
+    }
+    for _, test := range tests {
+        decoder, err := GetCodec(test.name)
+        if test.wantErr {
+            if err == nil {
+                t.Errorf("codec %q: expected error", test.name)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("codec %q: unexpected error %s", test.name, err)
+            continue
+        }
+        if decoder.Name() != test.want {
+            t.Errorf("codec %q: got %s, expected %s", test.name, decoder.Name(), test.want)
+        }
+    }
+}
+
+func TestCodecDecodeRecord(t *testing.T) {
+    record := map[string]interface{}{
+        "timestamp":    "2021-05-20T13:55:00.123Z",
+        "type":         "iBeacon",
+        "mac":          "AC233FA00102",
+        "rssi":         -61,
+        "ibeaconUUID":  "FDA50693A4E24FB1AFCFC6EB07647825",
+        "ibeaconMajor": 10,
+        "ibeaconMinor": 7,
+        "battery":      93,
+    }
+    for _, codecName := range []string{ CodecJson, CodecMsgpack } {
+        decoder, _ := GetCodec(codecName)
+        var decoded mg1Record
+        err := decoder.Decode(encodePayload(t, codecName, record), &decoded)
+        if err != nil {
+            t.Fatalf("%s: unable decode record: %s", codecName, err)
+        }
+        want := mg1Record{
+            Timestamp:      "2021-05-20T13:55:00.123Z",
+            Type:           "iBeacon",
+            Mac:            "AC233FA00102",
+            Rssi:           -61,
+            IbeaconUUID:    "FDA50693A4E24FB1AFCFC6EB07647825",
+            IbeaconMajor:   10,
+            IbeaconMinor:   7,
+            Battery:        93,
+        }
+        if decoded != want {
+            t.Errorf("%s: got %+v, expected %+v", codecName, decoded, want)
+        }
+    }
+}
+
+func TestCodecSplitArray(t *testing.T) {
+    tests := []struct {
+        codec       string
+        payload     interface{}
+        want        int
+        wantErr     bool
+    }{
+        { codec: CodecJson,     payload: []interface{}{ 1, "two", map[string]int{ "three": 3 } }, want: 3 },
+        { codec: CodecJson,     payload: []interface{}{}, want: 0 },
+        { codec: CodecJson,     payload: map[string]int{ "one": 1 }, wantErr: true },
+        { codec: CodecMsgpack,  payload: []interface{}{ 1, "two", map[string]int{ "three": 3 } }, want: 3 },
+        { codec: CodecMsgpack,  payload: []interface{}{}, want: 0 },
+        { codec: CodecMsgpack,  payload: "one", wantErr: true },
+        { codec: CodecMsgpack,  payload: map[string]int{ "one": 1 }, wantErr: true },
+    }
+    for i, test := range tests {
+        decoder, _ := GetCodec(test.codec)
+        elements, err := decoder.(ArrayCodec).SplitArray(encodePayload(t, test.codec, test.payload))
+        if test.wantErr {
+            if err == nil {
+                t.Errorf("test %d: expected error", i)
+            }
+            continue
+        }
+        if err != nil {
+            t.Errorf("test %d: unexpected error %s", i, err)
+            continue
+        }
+        if len(elements) != test.want {
+            t.Errorf("test %d: got %d elements, expected %d", i, len(elements), test.want)
+        }
+    }
+
+    // the element keeps its own encoding
+    decoder := NewMsgpackCodec()
+    elements, _ := decoder.SplitArray(encodePayload(t, CodecMsgpack, []string{ "first", "second" }))
+    var value string
+    err := decoder.Decode(elements[1], &value)
+    if err != nil || value != "second" {
+        t.Errorf("got %q, %v, expected second element", value, err)
+    }
+}
+
+func TestRawCodec(t *testing.T) {
+    decoder := NewRawCodec()
+    var value []byte
+    err := decoder.Decode([]byte("payload"), &value)
+    if err != nil || string(value) != "payload" {
+        t.Errorf("got %q, %v, expected payload", value, err)
+    }
+    var text string
+    if decoder.Decode([]byte("payload"), &text) == nil {
+        t.Errorf("expected error decoding into string")
+    }
+}
+//EOF
@@ -0,0 +1,85 @@
+
+package pmdrivers
+
+import (
+    "sync"
+    "time"
+)
+
+//
+// DeadLetters
+//
+const (
+    deadLetterLimit     int = 256
+    maxDeadPayload      int = 64 * 1024
+    deadQueueSize       int = 64        // letters waiting for republishing
+)
+
+type DeadLetter struct {
+    Time        time.Time   `json:"time"`
+    Topic       string      `json:"topic"`
+    Error       string      `json:"error"`
+    Payload     string      `json:"payload"`
+    Truncated   bool        `json:"truncated"`
+}
+
+func NewDeadLetter(topic string, payload []byte, err error) *DeadLetter {
+    letter := &DeadLetter{
+        Time:       time.Now(),
+        Topic:      topic,
+        Error:      err.Error(),
+    }
+    if len(payload) > maxDeadPayload {
+        payload = payload[:maxDeadPayload]
+        letter.Truncated = true
+    }
+    letter.Payload = string(payload)
+    return letter
+}
+
+// DeadLetters keeps last rejected payloads of a driver
+type DeadLetters struct {
+    list        []*DeadLetter
+    total       int64
+    mutex       sync.RWMutex
+}
+
+func NewDeadLetters() *DeadLetters {
+    var letters DeadLetters
+    letters.list = make([]*DeadLetter, 0)
+    return &letters
+}
+
+func (this *DeadLetters) Add(letter *DeadLetter) int64 {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    this.total++
+    this.list = append(this.list, letter)
+    if len(this.list) > deadLetterLimit {
+        this.list = append(make([]*DeadLetter, 0, deadLetterLimit), this.list[len(this.list) - deadLetterLimit:]...)
+    }
+    return this.total
+}
+
+// List returns kept letters, newest first
+func (this *DeadLetters) List() []*DeadLetter {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    result := make([]*DeadLetter, 0, len(this.list))
+    for i := len(this.list) - 1; i >= 0; i-- {
+        result = append(result, this.list[i])
+    }
+    return result
+}
+
+func (this *DeadLetters) Total() int64 {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    return this.total
+}
+
+// DeadLetterer is implemented by drivers keeping rejected payloads
+type DeadLetterer interface {
+    DeadLetters() []*DeadLetter
+}
+//EOF
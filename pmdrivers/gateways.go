@@ -0,0 +1,138 @@
+
+package pmdrivers
+
+import (
+    "encoding/json"
+    "fmt"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+//
+// Gateways
+//
+const (
+    gatewayTimeout  time.Duration = 10 * time.Minute
+)
+
+// Gateways keeps beacon state per gateway, so one wildcard
+// subject like /gw/+/status fans out into separate gateways.
+// Gateways are keyed by the mac from the topic, or by the
+// gateway record mac when the topic does not carry it.
+type Gateways struct {
+    list    map[string]*IBeacons
+    mutex   sync.RWMutex
+}
+
+func NewGateways() *Gateways {
+    var gateways Gateways
+    gateways.list = make(map[string]*IBeacons)
+    return &gateways
+}
+
+func (this *Gateways) MarshalJSON() ([]byte, error) {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    return json.Marshal(this.list)
+}
+
+// Single returns state of the only gateway, empty
+// state while the gateway is not seen yet
+func (this *Gateways) Single() (*IBeacons, bool) {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    switch len(this.list) {
+        case 0:
+            return NewIBeacons(), true
+        case 1:
+            for _, iBeacons := range this.list {
+                return iBeacons, true
+            }
+    }
+    return nil, false
+}
+
+// MacFromTopic returns <mac> of /gw/<mac>/status like topics
+func MacFromTopic(topic string) string {
+    if !strings.HasPrefix(topic, gatewayTopicPrefix) {
+        return ""
+    }
+    levels := strings.Split(strings.TrimPrefix(topic, gatewayTopicPrefix), "/")
+    if len(levels) < 2 || IsWildcardTopic(levels[0]) {
+        return ""
+    }
+    return levels[0]
+}
+
+// ValidateDiscoveryTopic checks the topic has the only wildcard,
+// the single level + at the mac position of /gw/<mac>/status
+// like topics, so the gateway topic is made by GatewayTopic
+func ValidateDiscoveryTopic(topic string) error {
+    levels := strings.Split(strings.TrimPrefix(topic, gatewayTopicPrefix), "/")
+    if !strings.HasPrefix(topic, gatewayTopicPrefix) || len(levels) < 2 || levels[0] != "+" ||
+            IsWildcardTopic(strings.Join(levels[1:], "/")) {
+        return fmt.Errorf("discovery topic %q must be like %s+/status with no other wildcard",
+                            topic, gatewayTopicPrefix)
+    }
+    return nil
+}
+
+// GatewayTopic puts the mac in place of + at the mac
+// position of the discovery topic
+func GatewayTopic(discoveryTopic string, mac string) string {
+    levels := strings.Split(strings.TrimPrefix(discoveryTopic, gatewayTopicPrefix), "/")
+    levels[0] = mac
+    return gatewayTopicPrefix + strings.Join(levels, "/")
+}
+
+// Get returns state of the gateway, creating it on first use
+func (this *Gateways) Get(mac string) *IBeacons {
+    this.mutex.RLock()
+    iBeacons, exists := this.list[mac]
+    this.mutex.RUnlock()
+    if exists {
+        return iBeacons
+    }
+
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    if iBeacons, exists = this.list[mac]; !exists {
+        iBeacons = NewIBeacons()
+        this.list[mac] = iBeacons
+    }
+    return iBeacons
+}
+
+func (this *Gateways) Find(mac string) *IBeacons {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    return this.list[mac]
+}
+
+func (this *Gateways) Macs() []string {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    macs := make([]string, 0, len(this.list))
+    for mac := range this.list {
+        macs = append(macs, mac)
+    }
+    sort.Strings(macs)
+    return macs
+}
+
+// Clean expires beacons and drops gateways silent for gatewayTimeout
+func (this *Gateways) Clean() {
+    limit := time.Now().Add(-gatewayTimeout)
+
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    for mac, iBeacons := range this.list {
+        iBeacons.Clean()
+        if iBeacons.Len() == 0 && iBeacons.GetLastSeen().Before(limit) {
+            delete(this.list, mac)
+        }
+    }
+}
+//EOF
@@ -0,0 +1,141 @@
+
+package pmdrivers
+
+import (
+    "encoding/json"
+    "sync"
+    "time"
+)
+
+//
+// GatewayHealth
+//
+const (
+    GatewayStatusOnline     string = "online"
+    GatewayStatusDegraded   string = "degraded"
+    GatewayStatusOffline    string = "offline"
+
+    healthWindow        time.Duration = 10 * time.Second
+    degradedTimeout     time.Duration = 15 * time.Second
+    offlineTimeout      time.Duration = 60 * time.Second
+    degradedErrorRate   float64 = 0.5
+)
+
+type HealthState struct {
+    Status          string      `json:"status"`
+    LastMessage     time.Time   `json:"lastMessage"`
+    MessageRate     float64     `json:"messageRate"`     // messages per second
+    ErrorRate       float64     `json:"errorRate"`       // share of bad payloads
+    GatewayLoad     float64     `json:"gatewayLoad"`
+    GatewayFree     int         `json:"gatewayFree"`
+}
+
+// GatewayHealth is computed from the gateway message cadence,
+// payload parse results and the gateway own status record
+type GatewayHealth struct {
+    HealthState
+    windowStart     time.Time
+    messages        int64
+    errors          int64
+    mutex           sync.RWMutex
+}
+
+func NewGatewayHealth() *GatewayHealth {
+    var health GatewayHealth
+    health.Status       = GatewayStatusOffline
+    health.windowStart  = time.Now()
+    return &health
+}
+
+func (this *GatewayHealth) MarshalJSON() ([]byte, error) {
+    return json.Marshal(this.Snapshot())
+}
+
+func (this *GatewayHealth) CountMessage(at time.Time, parseError bool) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    this.LastMessage = at
+    this.messages++
+    if parseError {
+        this.errors++
+    }
+}
+
+func (this *GatewayHealth) SetGatewayStatus(load float64, free int) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    this.GatewayLoad = load
+    this.GatewayFree = free
+}
+
+// Update recomputes rates at the end of each window and the status,
+// it reports whether the status changed
+func (this *GatewayHealth) Update(now time.Time) bool {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if span := now.Sub(this.windowStart); span >= healthWindow {
+        this.MessageRate = float64(this.messages) / span.Seconds()
+        this.ErrorRate = 0
+        if this.messages > 0 {
+            this.ErrorRate = float64(this.errors) / float64(this.messages)
+        }
+        this.messages    = 0
+        this.errors      = 0
+        this.windowStart = now
+    }
+
+    status := GatewayStatusOnline
+    silence := now.Sub(this.LastMessage)
+    switch {
+        case this.LastMessage.IsZero() || silence > offlineTimeout:
+            status = GatewayStatusOffline
+        case silence > degradedTimeout || this.ErrorRate > degradedErrorRate:
+            status = GatewayStatusDegraded
+    }
+    if status != this.Status {
+        this.Status = status
+        return true
+    }
+    return false
+}
+
+func (this *GatewayHealth) Snapshot() HealthState {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    return this.HealthState
+}
+
+var statusSeverity = map[string]int{
+    GatewayStatusOnline:    0,
+    GatewayStatusDegraded:  1,
+    GatewayStatusOffline:   2,
+}
+
+// AggregateHealth sums up gateways of a driver, the status is
+// the worst gateway status, no gateways are offline
+func AggregateHealth(states []HealthState) HealthState {
+    result := HealthState{ Status: GatewayStatusOffline }
+    var errorSum float64
+    for i, state := range states {
+        if i == 0 || statusSeverity[state.Status] > statusSeverity[result.Status] {
+            result.Status = state.Status
+        }
+        if state.LastMessage.After(result.LastMessage) {
+            result.LastMessage = state.LastMessage
+        }
+        result.MessageRate += state.MessageRate
+        errorSum += state.ErrorRate * state.MessageRate
+        if state.GatewayLoad > result.GatewayLoad {
+            result.GatewayLoad = state.GatewayLoad
+        }
+        if i == 0 || state.GatewayFree < result.GatewayFree {
+            result.GatewayFree = state.GatewayFree
+        }
+    }
+    if result.MessageRate > 0 {
+        result.ErrorRate = errorSum / result.MessageRate
+    }
+    return result
+}
+//EOF
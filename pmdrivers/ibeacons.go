@@ -0,0 +1,285 @@
+
+package pmdrivers
+
+import (
+    "container/heap"
+    "encoding/json"
+    "hash/fnv"
+    "sort"
+    "sync"
+    "time"
+)
+
+//
+// IBeacons
+//
+const (
+    gatewayTypeLabel string = "Gateway"
+
+    beaconTimeout   time.Duration = 10 * time.Second
+    clockSkewLimit  time.Duration = 5 * time.Second
+
+    beaconShardCount    int = 32
+)
+
+// IBeacons keeps the latest record of every beacon seen by the gateway.
+// Beacons are indexed by mac and spread over shards with own locks,
+// each shard keeps an expiry heap ordered by local receive time.
+type IBeacons struct {
+    GatewayMac  string          `json:"gatewayMac"`
+    ClockOffset int64           `json:"clockOffset"`  // ms, gateway minus local
+    ClockSkewed bool            `json:"clockSkewed"`
+    LastSeen    time.Time       `json:"lastSeen"`
+    Health      *GatewayHealth  `json:"health"`
+    shards      []*beaconShard  `json:"-"`
+    stateMutex  sync.RWMutex    `json:"-"`
+}
+
+func NewIBeacons() *IBeacons {
+    var iBeacons IBeacons
+    iBeacons.Health = NewGatewayHealth()
+    iBeacons.shards = make([]*beaconShard, beaconShardCount)
+    for i := range iBeacons.shards {
+        iBeacons.shards[i] = newBeaconShard()
+    }
+    return &iBeacons
+}
+
+// MarshalJSON keeps the {"gatewayMac": ..., "list": [...]} output shape
+func (this *IBeacons) MarshalJSON() ([]byte, error) {
+    this.stateMutex.RLock()
+    out := struct {
+        GatewayMac  string      `json:"gatewayMac"`
+        ClockOffset int64       `json:"clockOffset"`
+        ClockSkewed bool        `json:"clockSkewed"`
+        LastSeen    time.Time   `json:"lastSeen"`
+        Health      HealthState `json:"health"`
+        List        []*IBeacon  `json:"list"`
+    }{
+        GatewayMac:     this.GatewayMac,
+        ClockOffset:    this.ClockOffset,
+        ClockSkewed:    this.ClockSkewed,
+        LastSeen:       this.LastSeen,
+        Health:         this.Health.Snapshot(),
+    }
+    this.stateMutex.RUnlock()
+    out.List = this.List()
+    return json.Marshal(out)
+}
+
+func (this *IBeacons) ToJson() []byte {
+    jsonBytes, _ := json.MarshalIndent(this, "", "    ")
+    return jsonBytes
+}
+
+func (this *IBeacons) shard(mac string) *beaconShard {
+    hash := fnv.New32a()
+    hash.Write([]byte(mac))
+    return this.shards[hash.Sum32() % uint32(len(this.shards))]
+}
+
+func (this *IBeacons) GetGatewayMac() string {
+    this.stateMutex.RLock()
+    defer this.stateMutex.RUnlock()
+    return this.GatewayMac
+}
+
+func (this *IBeacons) GetLastSeen() time.Time {
+    this.stateMutex.RLock()
+    defer this.stateMutex.RUnlock()
+    return this.LastSeen
+}
+
+func (this *IBeacons) GetClockOffset() time.Duration {
+    this.stateMutex.RLock()
+    defer this.stateMutex.RUnlock()
+    return time.Duration(this.ClockOffset) * time.Millisecond
+}
+
+func (this *IBeacons) IsClockSkewed() bool {
+    this.stateMutex.RLock()
+    defer this.stateMutex.RUnlock()
+    return this.ClockSkewed
+}
+
+func (this *IBeacons) Add(beacon *IBeacon) {
+    if beacon.ReceivedAt.IsZero() {
+        beacon.ReceivedAt = time.Now()
+    }
+    this.stateMutex.Lock()
+    if beacon.ReceivedAt.After(this.LastSeen) {
+        this.LastSeen = beacon.ReceivedAt
+    }
+    if beacon.Type == gatewayTypeLabel {
+        this.GatewayMac = beacon.Mac
+        this.stateMutex.Unlock()
+        return
+    }
+    this.stateMutex.Unlock()
+    this.shard(beacon.Mac).add(beacon)
+}
+
+func (this *IBeacons) Delete(beacon *IBeacon) {
+    if beacon.Type == gatewayTypeLabel {
+        return
+    }
+    this.shard(beacon.Mac).delete(beacon.Mac)
+}
+
+func (this *IBeacons) Get(mac string) *IBeacon {
+    return this.shard(mac).get(mac)
+}
+
+func (this *IBeacons) Len() int {
+    count := 0
+    for i := range this.shards {
+        count += this.shards[i].len()
+    }
+    return count
+}
+
+// List returns beacons sorted by mac
+func (this *IBeacons) List() []*IBeacon {
+    list := make([]*IBeacon, 0, this.Len())
+    for i := range this.shards {
+        list = this.shards[i].appendTo(list)
+    }
+    sort.Slice(list, func(i, j int) bool {
+        return list[i].Mac < list[j].Mac
+    })
+    return list
+}
+
+// SetClockOffset stores the gateway clock offset and reports
+// whether the gateway crossed the skew limit in either direction.
+func (this *IBeacons) SetClockOffset(offset time.Duration) bool {
+    this.stateMutex.Lock()
+    defer this.stateMutex.Unlock()
+
+    this.ClockOffset = offset.Milliseconds()
+    skewed := offset > clockSkewLimit || offset < -clockSkewLimit
+    if skewed != this.ClockSkewed {
+        this.ClockSkewed = skewed
+        return true
+    }
+    return false
+}
+
+// Clean drops beacons not received for beaconTimeout. The local
+// receive time is used, so gateways with a wrong clock do not
+// make their beacons expire instantly or never.
+func (this *IBeacons) Clean() {
+    limit := time.Now().Add(-beaconTimeout)
+    for i := range this.shards {
+        this.shards[i].expire(limit)
+    }
+}
+
+//
+// beaconShard
+//
+type beaconEntry struct {
+    beacon  *IBeacon
+    index   int
+}
+
+type beaconHeap []*beaconEntry
+
+func (this beaconHeap) Len() int {
+    return len(this)
+}
+
+func (this beaconHeap) Less(i, j int) bool {
+    return this[i].beacon.ReceivedAt.Before(this[j].beacon.ReceivedAt)
+}
+
+func (this beaconHeap) Swap(i, j int) {
+    this[i], this[j] = this[j], this[i]
+    this[i].index = i
+    this[j].index = j
+}
+
+func (this *beaconHeap) Push(item interface{}) {
+    entry := item.(*beaconEntry)
+    entry.index = len(*this)
+    *this = append(*this, entry)
+}
+
+func (this *beaconHeap) Pop() interface{} {
+    old := *this
+    count := len(old)
+    entry := old[count - 1]
+    old[count - 1] = nil
+    entry.index = -1
+    *this = old[:count - 1]
+    return entry
+}
+
+type beaconShard struct {
+    index   map[string]*beaconEntry
+    expiry  beaconHeap
+    mutex   sync.RWMutex
+}
+
+func newBeaconShard() *beaconShard {
+    var shard beaconShard
+    shard.index  = make(map[string]*beaconEntry)
+    shard.expiry = make(beaconHeap, 0)
+    return &shard
+}
+
+func (this *beaconShard) add(beacon *IBeacon) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    if entry, exists := this.index[beacon.Mac]; exists {
+        entry.beacon = beacon
+        heap.Fix(&this.expiry, entry.index)
+        return
+    }
+    entry := &beaconEntry{ beacon: beacon }
+    this.index[beacon.Mac] = entry
+    heap.Push(&this.expiry, entry)
+}
+
+func (this *beaconShard) delete(mac string) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    if entry, exists := this.index[mac]; exists {
+        heap.Remove(&this.expiry, entry.index)
+        delete(this.index, mac)
+    }
+}
+
+func (this *beaconShard) get(mac string) *IBeacon {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    if entry, exists := this.index[mac]; exists {
+        return entry.beacon
+    }
+    return nil
+}
+
+func (this *beaconShard) len() int {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    return len(this.index)
+}
+
+func (this *beaconShard) appendTo(list []*IBeacon) []*IBeacon {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    for _, entry := range this.index {
+        list = append(list, entry.beacon)
+    }
+    return list
+}
+
+func (this *beaconShard) expire(limit time.Time) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    for len(this.expiry) > 0 && this.expiry[0].beacon.ReceivedAt.Before(limit) {
+        entry := heap.Pop(&this.expiry).(*beaconEntry)
+        delete(this.index, entry.beacon.Mac)
+    }
+}
+//EOF
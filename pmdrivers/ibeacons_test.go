@@ -0,0 +1,224 @@
+
+package pmdrivers
+
+import (
+    "encoding/json"
+    "fmt"
+    "testing"
+    "time"
+)
+
+func testBeacon(i int, receivedAt time.Time) *IBeacon {
+    return &IBeacon{
+        Type:       "iBeacon",
+        Mac:        fmt.Sprintf("AC233F%06X", i),
+        Rssi:       -60,
+        Battery:    90,
+        ReceivedAt: receivedAt,
+    }
+}
+
+// checkShards verifies the index and the heap of every shard
+// agree and the heap keeps the order by receive time
+func checkShards(t *testing.T, iBeacons *IBeacons) {
+    t.Helper()
+    for number, shard := range iBeacons.shards {
+        if len(shard.index) != len(shard.expiry) {
+            t.Fatalf("shard %d: index has %d entries, heap has %d",
+                        number, len(shard.index), len(shard.expiry))
+        }
+        for i, entry := range shard.expiry {
+            if entry.index != i {
+                t.Fatalf("shard %d: entry %s has index %d at %d", number, entry.beacon.Mac, entry.index, i)
+            }
+            if shard.index[entry.beacon.Mac] != entry {
+                t.Fatalf("shard %d: entry %s is not indexed", number, entry.beacon.Mac)
+            }
+            if i > 0 && shard.expiry.Less(i, (i - 1) / 2) {
+                t.Fatalf("shard %d: heap order is broken at %d", number, i)
+            }
+        }
+    }
+}
+
+func TestIBeaconsShards(t *testing.T) {
+    iBeacons := NewIBeacons()
+    now := time.Now()
+    for i := 0; i < 1000; i++ {
+        iBeacons.Add(testBeacon(i, now))
+    }
+    if iBeacons.Len() != 1000 {
+        t.Fatalf("expected 1000 beacons, got %d", iBeacons.Len())
+    }
+    used := 0
+    for _, shard := range iBeacons.shards {
+        if shard.len() > 0 {
+            used++
+        }
+    }
+    if used < beaconShardCount / 2 {
+        t.Errorf("beacons are spread over %d of %d shards", used, beaconShardCount)
+    }
+    for i := 0; i < 1000; i++ {
+        beacon := iBeacons.Get(testBeacon(i, now).Mac)
+        if beacon == nil {
+            t.Fatalf("beacon %d is lost", i)
+        }
+    }
+    list := iBeacons.List()
+    for i := 1; i < len(list); i++ {
+        if list[i - 1].Mac >= list[i].Mac {
+            t.Fatalf("list is not sorted at %d", i)
+        }
+    }
+    iBeacons.Delete(testBeacon(10, now))
+    if iBeacons.Get(testBeacon(10, now).Mac) != nil || iBeacons.Len() != 999 {
+        t.Errorf("beacon is not deleted")
+    }
+    gateway := testBeacon(2000, now)
+    gateway.Type = gatewayTypeLabel
+    iBeacons.Add(gateway)
+    if iBeacons.Len() != 999 || iBeacons.GetGatewayMac() != gateway.Mac {
+        t.Errorf("gateway record is kept as beacon")
+    }
+    checkShards(t, iBeacons)
+}
+
+func TestIBeaconsExpiry(t *testing.T) {
+    iBeacons := NewIBeacons()
+    now := time.Now()
+    stale := now.Add(-2 * beaconTimeout)
+    for i := 0; i < 500; i++ {
+        receivedAt := now
+        if i % 2 == 0 {
+            receivedAt = stale.Add(time.Duration(i) * time.Millisecond)
+        }
+        iBeacons.Add(testBeacon(i, receivedAt))
+    }
+    checkShards(t, iBeacons)
+    iBeacons.Clean()
+    if iBeacons.Len() != 250 {
+        t.Fatalf("expected 250 beacons after clean, got %d", iBeacons.Len())
+    }
+    for i := 0; i < 500; i++ {
+        kept := iBeacons.Get(testBeacon(i, now).Mac) != nil
+        if kept != (i % 2 == 1) {
+            t.Fatalf("beacon %d: kept %v", i, kept)
+        }
+    }
+    checkShards(t, iBeacons)
+}
+
+func TestIBeaconsUpdateAfterExpiry(t *testing.T) {
+    iBeacons := NewIBeacons()
+    now := time.Now()
+    stale := now.Add(-2 * beaconTimeout)
+
+    // the fresh update moves the stale beacon to the heap end
+    iBeacons.Add(testBeacon(1, stale))
+    iBeacons.Add(testBeacon(2, stale))
+    iBeacons.Add(testBeacon(1, now))
+    checkShards(t, iBeacons)
+    iBeacons.Clean()
+    if iBeacons.Get(testBeacon(1, now).Mac) == nil {
+        t.Fatalf("updated beacon is expired")
+    }
+    if iBeacons.Get(testBeacon(2, now).Mac) != nil {
+        t.Fatalf("stale beacon is kept")
+    }
+
+    // the expired beacon is added again as new entry
+    iBeacons.Add(testBeacon(2, now))
+    checkShards(t, iBeacons)
+    if iBeacons.Len() != 2 {
+        t.Fatalf("expected 2 beacons, got %d", iBeacons.Len())
+    }
+    iBeacons.Add(testBeacon(2, stale))
+    iBeacons.Clean()
+    if iBeacons.Len() != 1 || iBeacons.Get(testBeacon(2, now).Mac) != nil {
+        t.Fatalf("beacon turned stale by update is kept")
+    }
+    checkShards(t, iBeacons)
+}
+
+func TestIBeaconsMarshal(t *testing.T) {
+    iBeacons := NewIBeacons()
+    iBeacons.Add(testBeacon(1, time.Now()))
+    var out struct {
+        GatewayMac  string      `json:"gatewayMac"`
+        List        []*IBeacon  `json:"list"`
+    }
+    err := json.Unmarshal(iBeacons.ToJson(), &out)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(out.List) != 1 || out.List[0].Mac != testBeacon(1, time.Now()).Mac {
+        t.Errorf("unexpected list %v", out.List)
+    }
+}
+
+var benchmarkSizes = []int{ 10000, 50000 }
+
+func fillIBeacons(size int, receivedAt time.Time) *IBeacons {
+    iBeacons := NewIBeacons()
+    for i := 0; i < size; i++ {
+        iBeacons.Add(testBeacon(i, receivedAt))
+    }
+    return iBeacons
+}
+
+func BenchmarkIBeaconsUpdate(b *testing.B) {
+    for _, size := range benchmarkSizes {
+        b.Run(fmt.Sprintf("macs-%d", size), func(b *testing.B) {
+            iBeacons := fillIBeacons(size, time.Now())
+            beacons := make([]*IBeacon, size)
+            for i := range beacons {
+                beacons[i] = testBeacon(i, time.Now())
+            }
+            b.ResetTimer()
+            b.RunParallel(func(pb *testing.PB) {
+                i := 0
+                for pb.Next() {
+                    iBeacons.Add(beacons[i % size])
+                    i++
+                }
+            })
+        })
+    }
+}
+
+// BenchmarkIBeaconsClean expires a tenth of beacons on every run
+func BenchmarkIBeaconsClean(b *testing.B) {
+    for _, size := range benchmarkSizes {
+        b.Run(fmt.Sprintf("macs-%d", size), func(b *testing.B) {
+            now := time.Now()
+            stale := now.Add(-2 * beaconTimeout)
+            iBeacons := fillIBeacons(size, now)
+            b.ResetTimer()
+            for n := 0; n < b.N; n++ {
+                b.StopTimer()
+                for i := 0; i < size / 10; i++ {
+                    iBeacons.Add(testBeacon((n * size / 10 + i) % size, stale))
+                }
+                b.StartTimer()
+                iBeacons.Clean()
+            }
+        })
+    }
+}
+
+func BenchmarkIBeaconsMarshal(b *testing.B) {
+    for _, size := range benchmarkSizes {
+        b.Run(fmt.Sprintf("macs-%d", size), func(b *testing.B) {
+            iBeacons := fillIBeacons(size, time.Now())
+            b.ResetTimer()
+            for n := 0; n < b.N; n++ {
+                _, err := json.Marshal(iBeacons)
+                if err != nil {
+                    b.Fatal(err)
+                }
+            }
+        })
+    }
+}
+//EOF
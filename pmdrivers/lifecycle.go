@@ -0,0 +1,195 @@
+
+package pmdrivers
+
+import (
+    "encoding/json"
+    "fmt"
+    "runtime/debug"
+    "sync"
+    "time"
+
+    "app/pmlog"
+)
+
+//
+// Lifecycle
+//
+type DriverState string
+
+const (
+    StateCreated    DriverState = "created"
+    StateConnecting DriverState = "connecting"
+    StateRunning    DriverState = "running"
+    StateDegraded   DriverState = "degraded"
+    StateStopping   DriverState = "stopping"
+    StateStopped    DriverState = "stopped"
+    StateFailed     DriverState = "failed"
+)
+
+// stateTransitions lists allowed next states of every state,
+// stopped and failed drivers may be connected again
+var stateTransitions = map[DriverState][]DriverState{
+    StateCreated:       { StateConnecting, StateStopping, StateStopped },
+    StateConnecting:    { StateRunning, StateStopping, StateFailed },
+    StateRunning:       { StateDegraded, StateStopping, StateFailed },
+    StateDegraded:      { StateRunning, StateStopping, StateFailed },
+    StateStopping:      { StateStopped, StateFailed },
+    StateStopped:       { StateConnecting },
+    StateFailed:        { StateConnecting, StateStopping },
+}
+
+type DriverStatus struct {
+    State       DriverState     `json:"state"`
+    LastError   string          `json:"lastError"`
+    ChangedAt   time.Time       `json:"changedAt"`
+    StartedAt   time.Time       `json:"startedAt"`
+    StoppedAt   time.Time       `json:"stoppedAt"`
+    FailedAt    time.Time       `json:"failedAt"`
+}
+
+type Lifecycle struct {
+    driverId    string
+    status      DriverStatus
+    mutex       sync.RWMutex
+}
+
+func NewLifecycle(driverId string) *Lifecycle {
+    var lifecycle Lifecycle
+    lifecycle.driverId          = driverId
+    lifecycle.status.State      = StateCreated
+    lifecycle.status.ChangedAt  = time.Now()
+    return &lifecycle
+}
+
+func (this *Lifecycle) MarshalJSON() ([]byte, error) {
+    return json.Marshal(this.Status())
+}
+
+func (this *Lifecycle) Status() DriverStatus {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    return this.status
+}
+
+func (this *Lifecycle) State() DriverState {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    return this.status.State
+}
+
+// Transit moves the driver to the next state, the cause
+// is kept as the last error
+func (this *Lifecycle) Transit(next DriverState, cause error) error {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    current := this.status.State
+    if !canTransit(current, next) {
+        return fmt.Errorf("wrong driver state transition from %s to %s", current, next)
+    }
+    now := time.Now()
+    this.status.State     = next
+    this.status.ChangedAt = now
+    switch next {
+        case StateRunning:
+            if current == StateConnecting {
+                this.status.StartedAt = now
+            }
+        case StateStopped:
+            this.status.StoppedAt = now
+        case StateFailed:
+            this.status.FailedAt = now
+    }
+    if cause != nil {
+        this.status.LastError = cause.Error()
+    }
+
+    switch next {
+        case StateFailed, StateDegraded:
+            driverLogger.Warning("driver state changed", "driver", this.driverId,
+                        "from", current, "to", next, "error", cause)
+        default:
+            driverLogger.Info("driver state changed", "driver", this.driverId,
+                        "from", current, "to", next)
+    }
+    return nil
+}
+
+func canTransit(current, next DriverState) bool {
+    for _, state := range stateTransitions[current] {
+        if state == next {
+            return true
+        }
+    }
+    return false
+}
+
+//
+// MqttDriver lifecycle
+//
+func (this *MqttDriver) GetStatus() DriverStatus {
+    return this.Lifecycle.Status()
+}
+
+func (this *MqttDriver) GetState() DriverState {
+    return this.Lifecycle.State()
+}
+
+// logger returns the logger with driver fields, the name
+// may be set after the driver is created
+func (this *MqttDriver) logger() *pmlog.Logger {
+    return driverLogger.With("driver", this.Id, "class", this.ClassName, "name", this.Name)
+}
+
+// failDriver marks the driver failed and returns the cause
+func (this *MqttDriver) failDriver(cause error) error {
+    this.Lifecycle.Transit(StateFailed, cause)
+    return cause
+}
+
+// recoverLoop turns a panic of the driver loop into
+// the driver failure, it must be deferred in the loop
+func (this *MqttDriver) recoverLoop() {
+    if value := recover(); value != nil {
+        this.logger().Error("loop panic", "panic", value, "stack", string(debug.Stack()))
+        this.failDriver(fmt.Errorf("loop panic: %v", value))
+    }
+}
+
+// checkConnecting guards StartDriver, a driver is started
+// only after successful ConnectDriver
+func (this *MqttDriver) checkConnecting() error {
+    state := this.GetState()
+    if state != StateConnecting {
+        return fmt.Errorf("driver is %s, not connected", state)
+    }
+    return nil
+}
+
+// onConnectionChange degrades the running driver while
+// the transport reconnects to the broker
+func (this *MqttDriver) onConnectionChange(connected bool, cause error) {
+    this.setDegraded(&this.connectionLost, !connected, fmt.Errorf("connection lost: %s", cause))
+}
+
+// setTrafficLost degrades the running driver while the
+// subscribed topics are silent
+func (this *MqttDriver) setTrafficLost(lost bool, cause error) {
+    this.setDegraded(&this.trafficLost, lost, cause)
+}
+
+// setDegraded keeps the driver degraded while any of
+// the connection or traffic loss lasts
+func (this *MqttDriver) setDegraded(flag *bool, lost bool, cause error) {
+    this.degradeMutex.Lock()
+    defer this.degradeMutex.Unlock()
+    *flag = lost
+    state := this.GetState()
+    switch {
+        case lost && state == StateRunning:
+            this.Lifecycle.Transit(StateDegraded, cause)
+        case !this.connectionLost && !this.trafficLost && state == StateDegraded:
+            this.Lifecycle.Transit(StateRunning, nil)
+    }
+}
+//EOF
@@ -5,26 +5,68 @@ import (
     //"container/list"
     "time"
     "encoding/json"
-    "sync"
-
-    //"app/pmtools"
+    "errors"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+
+    "app/mqtrans"
+    "app/pmtools"
     "app/pmlog"
 )
 
 const (
     MG1ClassId    string = "53db7bc7-b406-11eb-900d-68f72872406b"
+    MG1ClassName  string = "MG1"
 
     statusTopicName  string = "StatusTopic"
     statusTopicValue string = "/gw/ac233fc0025f/status"
+
+    clockOffsetIndicatorName string = "GatewayClockOffset"
+    statusIndicatorName      string = "GatewayStatus"
+    lastMessageIndicatorName string = "LastMessageTime"
+    messageRateIndicatorName string = "MessageRate"
+    errorRateIndicatorName   string = "ParseErrorRate"
+    loadIndicatorName        string = "GatewayLoad"
+    freeIndicatorName        string = "GatewayFree"
+    rejectedIndicatorName    string = "RejectedMessages"
+
+    ConfigLowBatteryName string = "LowBatteryLevel"
+    ConfigFilterModeName string = "FilterMode"
+    ConfigDeadLetterTopicName string = "DeadLetterTopic"
+
+    FilterModeAll           string = "all"
+    FilterModeRegistered    string = "registered"
+    FilterModeDenyList      string = "denylist"
 )
 
 type MG1Driver struct {
     MqttDriver
-    IBeacons    *IBeacons    `json:"iBeacons"`
+    Gateways    *Gateways           `json:"-"`
+    listeners   []BeaconListener    `json:"-"`
+    filter      BeaconFilter        `json:"-"`
+    controls    *controlState       `json:"-"`
+    rejected    *DeadLetters        `json:"-"`
+    rejectLog   *logSampler         `json:"-"`
+    dropLog     *logSampler         `json:"-"`
+    deadQueue   chan deadMessage    `json:"-"`
+}
+
+type deadMessage struct {
+    topic       string
+    message     string
 }
 
 func NewMG1Driver() *MG1Driver {
+    return NewMG1DriverWithId("")
+}
+
+// NewMG1DriverWithId creates the driver known by the given id,
+// e.g. the persisted id of a discovered gateway driver
+func NewMG1DriverWithId(id string) *MG1Driver {
     var driver MG1Driver
+    driver.Id = id
     driver.InitializeDriver()
     return &driver
 }
@@ -33,73 +75,437 @@ func (this *MG1Driver) InitializeDriver() error {
     var err error
     this.MqttDriver.InitializeDriver()
     this.ClassId = MG1ClassId
-    this.IBeacons = NewIBeacons()
-
+    this.ClassName = MG1ClassName
+    this.Gateways = NewGateways()
+    this.controls = newControlState()
+    this.SetSubjectHandler(this.newSubjectHandler)
+    this.SetSubjectCodecs(mg1Codecs...)
+    this.rejected = NewDeadLetters()
+    this.rejectLog = newLogSampler(rejectLogPeriod)
+    this.dropLog = newLogSampler(rejectLogPeriod)
+    this.deadQueue = make(chan deadMessage, deadQueueSize)
+
+    this.Configs = append(this.Configs, this.NewLowBatteryConfig())
+    this.Configs = append(this.Configs, this.NewFilterModeConfig())
+    this.Configs = append(this.Configs, this.NewDeadLetterTopicConfig())
     this.Subjects = append(this.Subjects, this.NewStatusSubject())
+    this.Indicators = append(this.Indicators, this.NewClockOffsetIndicator())
+
+    healthIndicators := []string{
+        statusIndicatorName,
+        lastMessageIndicatorName,
+        messageRateIndicatorName,
+        errorRateIndicatorName,
+        loadIndicatorName,
+        freeIndicatorName,
+        rejectedIndicatorName,
+    }
+    for _, name := range healthIndicators {
+        this.Indicators = append(this.Indicators, this.NewHealthIndicator(name))
+    }
+
+    gatewayControls := []string{
+        ControlScanFilterName,
+        ControlUploadIntervalName,
+        ControlRssiFilterName,
+        ControlRebootName,
+    }
+    for _, name := range gatewayControls {
+        this.Controls = append(this.Controls, this.NewGatewayControl(name))
+    }
+    this.updateHealth()
+    this.SetIndicator(rejectedIndicatorName, []byte("0"))
     return err
 }
 
+// MarshalJSON keeps the "iBeacons" of single gateway drivers,
+// drivers with wildcard subjects or several gateways give
+// "gateways" by mac
+func (this *MG1Driver) MarshalJSON() ([]byte, error) {
+    out := struct {
+        *DriverSnapshot
+        Health      HealthState `json:"health"`
+        Gateways    *Gateways   `json:"gateways,omitempty"`
+        IBeacons    *IBeacons   `json:"iBeacons,omitempty"`
+    }{
+        DriverSnapshot: this.Snapshot(),
+        Health:         this.health(),
+    }
+    single, ok := this.Gateways.Single()
+    if ok && !this.hasWildcardSubject() {
+        out.IBeacons = single
+    } else {
+        out.Gateways = this.Gateways
+    }
+    return json.Marshal(out)
+}
+
+func (this *MG1Driver) AddListener(listener BeaconListener) {
+    this.listeners = append(this.listeners, listener)
+}
+
+func (this *MG1Driver) SetFilter(filter BeaconFilter) {
+    this.filter = filter
+}
+
+// acceptBeacon applies the driver filter mode to the beacon,
+// gateway records are always accepted
+func (this *MG1Driver) acceptBeacon(mode string, beacon *IBeacon) bool {
+    if beacon.Type == gatewayTypeLabel || this.filter == nil {
+        return true
+    }
+    switch mode {
+        case FilterModeRegistered:
+            return this.filter.Registered(beacon) && !this.filter.Denied(beacon)
+        case FilterModeDenyList:
+            return !this.filter.Denied(beacon)
+    }
+    return true
+}
+
+func (this *MG1Driver) notifyListeners(gatewayMac string, beacon *IBeacon) {
+    if beacon.Type == gatewayTypeLabel {
+        return
+    }
+    for i := range this.listeners {
+        this.listeners[i].HandleBeacon(this.Id, gatewayMac, beacon)
+    }
+}
+
+// NewLowBatteryConfig holds the driver low battery level in percent,
+// empty value means the application default
+func (this *MG1Driver) NewLowBatteryConfig() *Config {
+    config := NewConfig()
+    config.Name     = ConfigLowBatteryName
+    config.Id       = pmtools.GetNewUUID()
+    config.DriverId = this.Id
+    config.Schema   = &ConfigSchema{
+        Type:           ConfigTypeInt,
+        Min:            intLimit(0),
+        Max:            intLimit(100),
+        Description:    "low battery level in percent, empty for the application default",
+    }
+    return config
+}
+
+// NewFilterModeConfig selects which beacons the driver tracks:
+// all, registered tags only or all except deny-listed ones
+func (this *MG1Driver) NewFilterModeConfig() *Config {
+    config := NewConfig()
+    config.Name     = ConfigFilterModeName
+    config.Id       = pmtools.GetNewUUID()
+    config.DriverId = this.Id
+    config.Value    = []byte(FilterModeAll)
+    config.Schema   = &ConfigSchema{
+        Type:           ConfigTypeEnum,
+        Default:        FilterModeAll,
+        Values:         []string{ FilterModeAll, FilterModeRegistered, FilterModeDenyList },
+        Description:    "tracked beacons: all, registered tags only or all except deny-listed",
+    }
+    return config
+}
+
+// NewDeadLetterTopicConfig holds the topic rejected payloads
+// are republished to, empty value disables republishing
+func (this *MG1Driver) NewDeadLetterTopicConfig() *Config {
+    config := NewConfig()
+    config.Name     = ConfigDeadLetterTopicName
+    config.Id       = pmtools.GetNewUUID()
+    config.DriverId = this.Id
+    config.Schema   = &ConfigSchema{
+        Type:           ConfigTypeTopic,
+        Description:    "topic to republish rejected payloads to, empty to disable",
+    }
+    return config
+}
+
+func (this *MG1Driver) NewClockOffsetIndicator() *Indicator {
+    indicator := NewIndicator()
+    indicator.Name      = clockOffsetIndicatorName
+    indicator.Id        = pmtools.GetNewUUID()
+    indicator.DriverId  = this.Id
+    indicator.Value     = []byte("0")
+    indicator.Enabled   = true
+    return indicator
+}
+
+func (this *MG1Driver) NewHealthIndicator(name string) *Indicator {
+    indicator := NewIndicator()
+    indicator.Name      = name
+    indicator.Id        = pmtools.GetNewUUID()
+    indicator.DriverId  = this.Id
+    indicator.Enabled   = true
+    return indicator
+}
+
 func (this *MG1Driver) NewStatusSubject() *Subject {
     subject := NewSubject()
-    subject.Name    = statusTopicName
-    subject.Value   = []byte(statusTopicValue)
-    subject.Type    = subjectTypeMqttTopic
+    subject.Name     = statusTopicName
+    subject.Id       = pmtools.GetNewUUID()
+    subject.DriverId = this.Id
+    subject.Value    = []byte(statusTopicValue)
+    subject.Type     = subjectTypeMqttTopic
+    subject.Enabled  = true
     return subject
 }
 
 func (this *MG1Driver) StartDriver() error {
     var err error
+    err = this.checkConnecting()
+    if err != nil {
+        return err
+    }
+    err = this.ConnectSubjects()
+    if err != nil {
+        this.DisconnectSubjects()
+        return this.failDriver(err)
+    }
+    err = this.subscribeControlResponses()
+    if err != nil {
+        this.logger().Warning("unable subscribe control responses", "error", err)
+    }
 
+    this.StartLoop()
+    return this.Lifecycle.Transit(StateRunning, nil)
+}
+
+// newSubjectHandler makes the status topic handler decoding
+// payloads with the subject codec
+func (this *MG1Driver) newSubjectHandler(subject *Subject) (mqtrans.Handler, error) {
+    decoder, err := GetCodec(subject.Codec)
+    if err != nil {
+        return nil, err
+    }
+    logger := this.logger().With("subject", subject.Name, "topic", string(subject.Value))
     handler := func(subject string, payload []byte) {
-        pmlog.LogDebug("driver", this.Id, "handled subject", subject)
-        iBeacons := make([]IBeacon, 0)
-        _ = json.Unmarshal(payload, &iBeacons)
+        receivedAt := time.Now()
+        logger.Debug("handled subject")
+        topicMac := MacFromTopic(subject)
+        gateway := this.Gateways.Get(topicMac)
+        iBeacons, rejected, err := decodeMG1Payload(decoder, payload)
+        gateway.Health.CountMessage(receivedAt, err != nil || (len(iBeacons) == 0 && len(rejected) > 0))
+        if err != nil {
+            this.rejectPayload(subject, payload, err)
+            return
+        }
+        for i := range rejected {
+            this.rejectPayload(subject, rejected[i].payload, rejected[i].err)
+        }
+        filterMode, _ := this.GetConfig(ConfigFilterModeName)
+
+        // gateway records go first, so beacons get the gateway mac
+        sort.SliceStable(iBeacons, func(i, j int) bool {
+            return iBeacons[i].Type == gatewayTypeLabel && iBeacons[j].Type != gatewayTypeLabel
+        })
+
+        var gatewayTime time.Time
         for i := range iBeacons {
-            this.IBeacons.Add(&iBeacons[i])
+            if !this.acceptBeacon(string(filterMode), &iBeacons[i]) {
+                continue
+            }
+            if iBeacons[i].Type == gatewayTypeLabel {
+                gateway.Health.SetGatewayStatus(iBeacons[i].GatewayLoad, iBeacons[i].GatewayFree)
+            }
+            iBeacons[i].ReceivedAt = receivedAt
+            if iBeacons[i].Timestamp.After(gatewayTime) {
+                gatewayTime = iBeacons[i].Timestamp
+            }
+            gateway.Add(&iBeacons[i])
+            gatewayMac := gateway.GetGatewayMac()
+            if len(gatewayMac) == 0 {
+                gatewayMac = strings.ToUpper(topicMac)
+            }
+            this.notifyListeners(gatewayMac, &iBeacons[i])
+        }
+        if !gatewayTime.IsZero() {
+            this.updateClockOffset(gateway, gatewayTime, receivedAt)
+        }
+        // the gateway dump is costly, skip it unless debug is enabled
+        if logger.Enabled(pmlog.LevelDebug) {
+            logger.Debug("gateway beacons", "beacons", string(gateway.ToJson()))
+        }
+    }
+    return handler, err
+}
+
+// rejectPayload keeps the bad payload as dead letter, optionally
+// queues it for republishing and logs a sample of rejections.
+// Letters are dropped while the queue is full.
+func (this *MG1Driver) rejectPayload(topic string, payload []byte, err error) {
+    letter := NewDeadLetter(topic, payload, err)
+    total := this.rejected.Add(letter)
+    this.SetIndicator(rejectedIndicatorName, []byte(strconv.FormatInt(total, 10)))
+
+    if allow, suppressed := this.rejectLog.Allow(letter.Time); allow {
+        this.logger().Warning("rejected payload", "topic", topic, "error", err,
+                            "suppressed", suppressed)
+    }
+
+    deadTopic, _ := this.GetConfig(ConfigDeadLetterTopicName)
+    if len(deadTopic) == 0 {
+        return
+    }
+    message, _ := json.Marshal(letter)
+    select {
+        case this.deadQueue <- deadMessage{ topic: string(deadTopic), message: string(message) }:
+        default:
+            if allow, suppressed := this.dropLog.Allow(letter.Time); allow {
+                this.logger().Warning("dead letter queue is full, letter is dropped",
+                            "topic", string(deadTopic), "suppressed", suppressed)
+            }
+    }
+}
+
+// publishDeadLetters republishes queued letters one by one,
+// it runs with the driver loop
+func (this *MG1Driver) publishDeadLetters() {
+    defer this.wg.Done()
+    for {
+        select {
+            case <- this.context.Done():
+                return
+            case letter := <- this.deadQueue:
+                err := this.mqt.Publish(letter.topic, letter.message)
+                if err != nil {
+                    this.logger().Warning("unable publish dead letter", "topic", letter.topic, "error", err)
+                }
         }
-        pmlog.LogDebug(string(this.IBeacons.ToJson()))
     }
+}
 
-    //this.ConnectSubjects()
-    for i := range this.Subjects {
-        if this.Subjects[i].Type == subjectTypeMqttTopic {
-            topic := string(this.Subjects[i].Value)
-            this.mqt.Subscribe(topic, handler)
-            pmlog.LogDebug("driver", this.Id, "subsribed to topic", topic)
+func (this *MG1Driver) DeadLetters() []*DeadLetter {
+    return this.rejected.List()
+}
+
+func (this *MG1Driver) updateClockOffset(gateway *IBeacons, gatewayTime, receivedAt time.Time) {
+    offset := gatewayTime.Sub(receivedAt)
+    skewChanged := gateway.SetClockOffset(offset)
+    if skewChanged {
+        if gateway.IsClockSkewed() {
+            this.logger().Warning("gateway clock is skewed", "gateway", gateway.GetGatewayMac(), "offset", offset)
+        } else {
+            this.logger().Info("gateway clock is in sync again", "gateway", gateway.GetGatewayMac())
         }
     }
+}
 
-    this.StartLoop()
-    return err
+// health sums up health of the driver gateways
+func (this *MG1Driver) health() HealthState {
+    states := make([]HealthState, 0)
+    for _, mac := range this.Gateways.Macs() {
+        if gateway := this.Gateways.Find(mac); gateway != nil {
+            states = append(states, gateway.Health.Snapshot())
+        }
+    }
+    return AggregateHealth(states)
+}
+
+// updateHealth recomputes health of every gateway and publishes
+// the driver sum as indicators. Gateways silent for offlineTimeout
+// degrade the driver, so does a driver seeing no gateways.
+func (this *MG1Driver) updateHealth() {
+    now := time.Now()
+    states := make([]HealthState, 0)
+    silent := make([]string, 0)
+    var clockOffset time.Duration
+    for _, mac := range this.Gateways.Macs() {
+        gateway := this.Gateways.Find(mac)
+        if gateway == nil {
+            continue
+        }
+        statusChanged := gateway.Health.Update(now)
+        health := gateway.Health.Snapshot()
+        states = append(states, health)
+
+        gatewayMac := gateway.GetGatewayMac()
+        if len(gatewayMac) == 0 {
+            gatewayMac = mac
+        }
+        if health.Status == GatewayStatusOffline {
+            silent = append(silent, gatewayMac)
+        }
+        // the indicator shows the most skewed gateway
+        if offset := gateway.GetClockOffset(); absDuration(offset) > absDuration(clockOffset) {
+            clockOffset = offset
+        }
+        if statusChanged {
+            switch health.Status {
+                case GatewayStatusOnline:
+                    this.logger().Info("gateway is online", "gateway", gatewayMac)
+                default:
+                    this.logger().Warning("gateway is not online", "gateway", gatewayMac,
+                                "status", health.Status)
+            }
+        }
+    }
+    health := AggregateHealth(states)
+
+    lastMessage := ""
+    if !health.LastMessage.IsZero() {
+        lastMessage = health.LastMessage.Format(time.RFC3339)
+    }
+    this.SetIndicator(statusIndicatorName, []byte(health.Status))
+    this.SetIndicator(lastMessageIndicatorName, []byte(lastMessage))
+    this.SetIndicator(messageRateIndicatorName, []byte(strconv.FormatFloat(health.MessageRate, 'f', 2, 64)))
+    this.SetIndicator(errorRateIndicatorName, []byte(strconv.FormatFloat(health.ErrorRate, 'f', 3, 64)))
+    this.SetIndicator(loadIndicatorName, []byte(strconv.FormatFloat(health.GatewayLoad, 'f', 2, 64)))
+    this.SetIndicator(freeIndicatorName, []byte(strconv.Itoa(health.GatewayFree)))
+    this.SetIndicator(clockOffsetIndicatorName, []byte(strconv.FormatInt(clockOffset.Milliseconds(), 10)))
+
+    startedAt := this.GetStatus().StartedAt
+    running := !startedAt.IsZero() && now.Sub(startedAt) > offlineTimeout
+    switch {
+        case len(silent) > 0:
+            this.setTrafficLost(true, fmt.Errorf("traffic lost, gateways %s are silent",
+                                                strings.Join(silent, ", ")))
+        case len(states) == 0 && running:
+            this.setTrafficLost(true, errors.New("traffic lost, no gateways are seen"))
+        default:
+            this.setTrafficLost(false, nil)
+    }
+}
+
+func absDuration(value time.Duration) time.Duration {
+    if value < 0 {
+        return -value
+    }
+    return value
 }
 
 func (this *MG1Driver) StartLoop() error {
     var err error
 
+    this.wg.Add(1)
     loopFunc := func() {
-        this.wg.Add(1)
         defer this.wg.Done()
+        defer this.recoverLoop()
 
-        pmlog.LogInfo("driver", this.Id, "loop started")
+        this.logger().Info("loop started")
         timer := time.NewTicker(loopPeriod * time.Millisecond)
-        for _ = range timer.C {
+        defer timer.Stop()
+        for {
             select {
                 case <- this.context.Done():
-                    pmlog.LogInfo("driver", this.Id, "loop canceled")
+                    this.logger().Info("loop canceled")
                     return
-                default:
+                case <- timer.C:
             }
 
             now := int64(time.Now().Unix())
             switch {
                 case now % 5 == 0:
-                    pmlog.LogInfo("driver", this.Id, "is alive")
+                    this.logger().Debug("driver is alive")
             }
 
-            this.IBeacons.Clean()
+            this.Gateways.Clean()
+            this.updateHealth()
+            this.expireControls()
         }
     }
     go loopFunc()
+
+    this.wg.Add(1)
+    go this.publishDeadLetters()
     return err
 }
 
@@ -108,17 +514,18 @@ func (this *MG1Driver) StartLoop() error {
 // IBeacon
 //
 type IBeacon struct {
-    Timestamp      time.Time `json:"timestamp"`
+    Timestamp      time.Time `json:"timestamp"`      // gateway clock
+    ReceivedAt     time.Time `json:"receivedAt"`     // local clock
     Type           string    `json:"type"`
     Mac            string    `json:"mac"`
-    //GatewayFree    int       `json:"gatewayFree,omitempty"`
-    //GatewayLoad    float64   `json:"gatewayLoad,omitempty"`
+    GatewayFree    int       `json:"gatewayFree,omitempty"`
+    GatewayLoad    float64   `json:"gatewayLoad,omitempty"`
     //BleName        string    `json:"bleName,omitempty"`
     Rssi           int       `json:"rssi,omitempty"`
     //RawData        string    `json:"rawData,omitempty"`
-    //IbeaconUUID    string    `json:"ibeaconUUID,omitempty"`
-    //IbeaconMajor   int       `json:"ibeaconMajor,omitempty"`
-    //IbeaconMinor   int       `json:"ibeaconMinor,omitempty"`
+    IbeaconUUID    string    `json:"ibeaconUUID,omitempty"`
+    IbeaconMajor   int       `json:"ibeaconMajor,omitempty"`
+    IbeaconMinor   int       `json:"ibeaconMinor,omitempty"`
     //IbeaconTxPower int       `json:"ibeaconTxPower,omitempty"`
     Battery        int       `json:"battery"`
 }
@@ -132,79 +539,15 @@ func NewIBeacon() *IBeacon{
     return &IBeacon{}
 }
 
-
-//
-// IBeacons
-//
-const (
-    gatewayTypeLabel string = "Gateway"
-)
-
-type IBeacons struct {
-    GatewayMac  string          `json:"gatewayMac"`
-    List        []*IBeacon      `json:"list"`
-    listMutex   sync.Mutex      `json:"-"`
+// BeaconListener receives every beacon sighting handled by a driver
+type BeaconListener interface {
+    HandleBeacon(driverId string, gatewayMac string, beacon *IBeacon)
 }
 
-func NewIBeacons() *IBeacons {
-    var iBeacons IBeacons
-    iBeacons.List = make([]*IBeacon, 0)
-    return &iBeacons
+// BeaconFilter tells drivers which beacons are known tags
+type BeaconFilter interface {
+    Registered(beacon *IBeacon) bool
+    Denied(beacon *IBeacon) bool
 }
 
-func (this *IBeacons) ToJson() []byte {
-    jsonBytes, _ := json.MarshalIndent(this, "", "    ")
-    return jsonBytes
-}
-
-func (this *IBeacons) Add(beacon *IBeacon) {
-    if beacon.Type == gatewayTypeLabel {
-        this.GatewayMac = beacon.Mac
-        return
-    }
-    this.listMutex.Lock()
-    defer this.listMutex.Unlock()
-    for i := range this.List {
-        if this.List[i].Mac == beacon.Mac {
-            this.List[i] = beacon
-            return
-            //this.List = append(this.List[:i], this.List[i:]...)
-            //break
-        }
-    }
-    this.List = append(this.List, beacon)
-}
-
-func (this *IBeacons) Delete(beacon *IBeacon) {
-    beacon.Timestamp = time.Now()
-    if beacon.Type == gatewayTypeLabel {
-        return
-    }
-    this.listMutex.Lock()
-    defer this.listMutex.Unlock()
-    for i := range this.List {
-        if this.List[i].Mac == beacon.Mac {
-            this.List = append(this.List[:i], this.List[i:]...)
-            return
-        }
-    }
-}
-
-func (this *IBeacons) Clean() {
-    this.listMutex.Lock()
-    defer this.listMutex.Unlock()
-
-    tmpList := make([]*IBeacon, 0)
-    for i := range this.List {
-        //pmlog.LogDebug(time.Since(this.List[i].Timestamp))
-        if time.Since(this.List[i].Timestamp) < (10 * time.Second) {
-            tmpList = append(tmpList, this.List[i])
-        }
-    }
-    if len(this.List) != len(tmpList) {
-        this.List = tmpList
-    }
-}
-
-
 //EOF
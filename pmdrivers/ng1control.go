@@ -0,0 +1,280 @@
+
+package pmdrivers
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+
+    "app/pmtools"
+)
+
+//
+// MG1 gateway controls
+//
+// Commands are published to /gw/<mac>/action as
+//   {"action": "config.set", "requestId": "...", "data": {...}}
+// and the gateway answers to /gw/<mac>/action/response with
+//   {"requestId": "...", "code": 0, "message": "..."}
+//
+const (
+    ControlScanFilterName       string = "ScanFilter"
+    ControlUploadIntervalName   string = "UploadInterval"
+    ControlRssiFilterName       string = "RssiFilter"
+    ControlRebootName           string = "Reboot"
+
+    actionConfigSet     string = "config.set"
+    actionReboot        string = "reboot"
+
+    gatewayTopicPrefix  string = "/gw/"
+    statusTopicSuffix   string = "/status"
+    actionTopicSuffix   string = "/action"
+    responseTopicSuffix string = "/action/response"
+
+    controlTimeout      time.Duration = 30 * time.Second
+
+    minUploadInterval   int = 1         // sec
+    maxUploadInterval   int = 3600
+    minRssiFilter       int = -127      // dBm
+    maxRssiFilter       int = 0
+)
+
+type gatewayAction struct {
+    Action      string          `json:"action"`
+    RequestId   string          `json:"requestId"`
+    Data        interface{}     `json:"data,omitempty"`
+}
+
+type gatewayResponse struct {
+    RequestId   string          `json:"requestId"`
+    Code        int             `json:"code"`
+    Message     string          `json:"message"`
+}
+
+// controlState keeps requests waiting for the gateway
+// response, guarded by the driver control mutex
+type controlState struct {
+    pending     map[string]*Control
+}
+
+func newControlState() *controlState {
+    var state controlState
+    state.pending = make(map[string]*Control)
+    return &state
+}
+
+func (this *MG1Driver) NewGatewayControl(name string) *Control {
+    control := NewControl()
+    control.Name        = name
+    control.Id          = pmtools.GetNewUUID()
+    control.DriverId    = this.Id
+    control.Enabled     = true
+    return control
+}
+
+// gatewayMac returns the gateway mac as used in topics, taken
+// from the status subject or from the only known gateway
+func (this *MG1Driver) gatewayMac() string {
+    subjects := this.GetSubjects()
+    for i := range subjects {
+        topic := string(subjects[i].Value)
+        if strings.HasSuffix(topic, statusTopicSuffix) {
+            if mac := MacFromTopic(topic); len(mac) > 0 {
+                return mac
+            }
+        }
+    }
+    macs := this.Gateways.Macs()
+    if len(macs) == 1 {
+        if len(macs[0]) > 0 {
+            return macs[0]
+        }
+        return strings.ToLower(this.Gateways.Get(macs[0]).GetGatewayMac())
+    }
+    return ""
+}
+
+// controlGateway returns the gateway mac as used in topics,
+// the gateway must be served by the driver. The mac may be
+// omitted when the driver serves a single gateway.
+func (this *MG1Driver) controlGateway(mac string) (string, error) {
+    if len(mac) == 0 {
+        mac = this.gatewayMac()
+        if len(mac) == 0 {
+            return "", errors.New("gateway is required, driver serves several or unknown gateways")
+        }
+        return mac, nil
+    }
+    for _, known := range this.Gateways.Macs() {
+        if len(known) > 0 && strings.EqualFold(known, mac) {
+            return known, nil
+        }
+        iBeacons := this.Gateways.Find(known)
+        if len(known) == 0 && iBeacons != nil && strings.EqualFold(iBeacons.GetGatewayMac(), mac) {
+            return strings.ToLower(mac), nil
+        }
+    }
+    subjects := this.GetSubjects()
+    for i := range subjects {
+        topic := string(subjects[i].Value)
+        if known := MacFromTopic(topic); len(known) > 0 && strings.EqualFold(known, mac) {
+            return known, nil
+        }
+    }
+    return "", fmt.Errorf("gateway %s is not served by the driver", mac)
+}
+
+// buildAction validates the control value and makes the gateway command
+func buildAction(name string, value []byte) (*gatewayAction, error) {
+    var err error
+    action := &gatewayAction{
+        Action:     actionConfigSet,
+        RequestId:  pmtools.GetNewUUID(),
+    }
+    switch name {
+        case ControlScanFilterName:
+            filter := make(map[string]interface{})
+            err = json.Unmarshal(value, &filter)
+            if err != nil {
+                return nil, fmt.Errorf("wrong scan filter: %s", err)
+            }
+            action.Data = map[string]interface{}{ "scanFilter": filter }
+
+        case ControlUploadIntervalName:
+            var interval int
+            interval, err = strconv.Atoi(strings.TrimSpace(string(value)))
+            if err != nil || interval < minUploadInterval || interval > maxUploadInterval {
+                return nil, fmt.Errorf("upload interval must be %d..%d sec", minUploadInterval, maxUploadInterval)
+            }
+            action.Data = map[string]interface{}{ "uploadInterval": interval }
+
+        case ControlRssiFilterName:
+            var rssi int
+            rssi, err = strconv.Atoi(strings.TrimSpace(string(value)))
+            if err != nil || rssi < minRssiFilter || rssi > maxRssiFilter {
+                return nil, fmt.Errorf("rssi filter must be %d..%d dBm", minRssiFilter, maxRssiFilter)
+            }
+            action.Data = map[string]interface{}{ "rssiFilter": rssi }
+
+        case ControlRebootName:
+            action.Action = actionReboot
+
+        default:
+            return nil, errors.New("control not found")
+    }
+    return action, err
+}
+
+// ExecControl publishes the control command to the gateway,
+// the control status tracks the gateway response
+func (this *MG1Driver) ExecControl(name, gateway string, value []byte) (string, error) {
+    var err error
+
+    var control *Control
+    for i := range this.Controls {
+        if this.Controls[i].Name == name {
+            control = this.Controls[i]
+            break
+        }
+    }
+    if control == nil || !control.Enabled {
+        return "", errors.New("control not found")
+    }
+    action, err := buildAction(name, value)
+    if err != nil {
+        return "", err
+    }
+    mac, err := this.controlGateway(gateway)
+    if err != nil {
+        return "", err
+    }
+    payload, err := json.Marshal(action)
+    if err != nil {
+        return "", err
+    }
+
+    this.controlMutex.Lock()
+    control.Value       = value
+    control.Gateway     = mac
+    control.RequestId   = action.RequestId
+    control.Status      = ControlStatusPending
+    control.Response    = nil
+    control.UpdatedAt   = time.Now()
+    this.controls.pending[action.RequestId] = control
+    this.controlMutex.Unlock()
+
+    topic := gatewayTopicPrefix + mac + actionTopicSuffix
+    err = this.mqt.Publish(topic, string(payload))
+    if err != nil {
+        this.finishControl(action.RequestId, ControlStatusFailed, []byte(err.Error()))
+        return "", err
+    }
+    this.logger().Info("sent control", "control", name, "request", action.RequestId, "topic", topic)
+    return action.RequestId, err
+}
+
+func (this *MG1Driver) finishControl(requestId string, status ControlStatus, response []byte) {
+    this.controlMutex.Lock()
+    defer this.controlMutex.Unlock()
+    control, exists := this.controls.pending[requestId]
+    if !exists {
+        return
+    }
+    delete(this.controls.pending, requestId)
+    if control.RequestId != requestId {
+        return
+    }
+    control.Status      = status
+    control.Response    = response
+    control.UpdatedAt   = time.Now()
+}
+
+func (this *MG1Driver) handleControlResponse(topic string, payload []byte) {
+    var response gatewayResponse
+    err := json.Unmarshal(payload, &response)
+    if err != nil {
+        this.logger().Warning("wrong control response", "topic", topic, "error", err)
+        return
+    }
+    status := ControlStatusDone
+    if response.Code != 0 {
+        status = ControlStatusFailed
+        this.logger().Warning("control request failed", "request", response.RequestId, "error", response.Message)
+    }
+    this.finishControl(response.RequestId, status, payload)
+}
+
+// expireControls marks requests without gateway response as timed out
+func (this *MG1Driver) expireControls() {
+    limit := time.Now().Add(-controlTimeout)
+    this.controlMutex.Lock()
+    defer this.controlMutex.Unlock()
+    for requestId, control := range this.controls.pending {
+        if control.UpdatedAt.Before(limit) {
+            delete(this.controls.pending, requestId)
+            if control.RequestId != requestId {
+                continue
+            }
+            control.Status      = ControlStatusTimeout
+            control.UpdatedAt   = time.Now()
+            this.logger().Warning("control request timed out", "request", requestId)
+        }
+    }
+}
+
+// subscribeControlResponses listens responses of all gateways,
+// so subjects may change at runtime, responses to unknown
+// requests are ignored
+func (this *MG1Driver) subscribeControlResponses() error {
+    topic := gatewayTopicPrefix + "+" + responseTopicSuffix
+    err := this.mqt.Subscribe(topic, this.handleControlResponse)
+    if err != nil {
+        return err
+    }
+    this.logger().Debug("subscribed to topic", "topic", topic)
+    return err
+}
+//EOF
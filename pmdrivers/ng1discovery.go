@@ -0,0 +1,159 @@
+
+package pmdrivers
+
+import (
+    "encoding/json"
+    "sync"
+    "time"
+
+    "app/mqtrans"
+    "app/pmtools"
+)
+
+//
+// MG1DiscoveryDriver
+//
+// MG1DiscoveryDriver listens a wildcard status topic and reports
+// gateways it sees, the application decides whether to create
+// MG1 drivers for them
+const (
+    MG1DiscoveryClassId     string = "6be57ee0-cb54-11f1-a416-02fc00000001"
+    MG1DiscoveryClassName   string = "MG1Discovery"
+
+    discoveryTopicName      string = "DiscoveryTopic"
+    discoveryTopicValue     string = "/gw/+/status"
+
+    ConfigApprovalRequiredName  string = "ApprovalRequired"
+)
+
+// DiscoveryHandler is called once per new gateway mac with
+// the subject the gateway was seen on
+type DiscoveryHandler = func(driverId string, mac string, subject *Subject)
+
+type MG1DiscoveryDriver struct {
+    MqttDriver
+    Discovered  *seenGateways       `json:"discovered"`
+    onDiscover  DiscoveryHandler    `json:"-"`
+}
+
+func NewMG1DiscoveryDriver() *MG1DiscoveryDriver {
+    var driver MG1DiscoveryDriver
+    driver.InitializeDriver()
+    return &driver
+}
+
+func (this *MG1DiscoveryDriver) InitializeDriver() error {
+    var err error
+    this.MqttDriver.InitializeDriver()
+    this.ClassId = MG1DiscoveryClassId
+    this.ClassName = MG1DiscoveryClassName
+    this.Discovered = newSeenGateways()
+
+    this.Configs = append(this.Configs, this.NewApprovalConfig())
+    this.Subjects = append(this.Subjects, this.NewDiscoverySubject())
+    this.SetSubjectHandler(this.newSubjectHandler)
+    this.SetTopicValidator(ValidateDiscoveryTopic)
+    return err
+}
+
+func (this *MG1DiscoveryDriver) MarshalJSON() ([]byte, error) {
+    out := struct {
+        *DriverSnapshot
+        Discovered  *seenGateways   `json:"discovered"`
+    }{
+        DriverSnapshot: this.Snapshot(),
+        Discovered:     this.Discovered,
+    }
+    return json.Marshal(out)
+}
+
+// NewApprovalConfig tells whether discovered gateways wait
+// for operator approval, "true" or "false"
+func (this *MG1DiscoveryDriver) NewApprovalConfig() *Config {
+    config := NewConfig()
+    config.Name     = ConfigApprovalRequiredName
+    config.Id       = pmtools.GetNewUUID()
+    config.DriverId = this.Id
+    config.Value    = []byte("true")
+    config.Schema   = &ConfigSchema{
+        Type:           ConfigTypeBool,
+        Default:        "true",
+        Description:    "discovered gateways wait for operator approval",
+    }
+    return config
+}
+
+func (this *MG1DiscoveryDriver) NewDiscoverySubject() *Subject {
+    subject := NewSubject()
+    subject.Name     = discoveryTopicName
+    subject.Id       = pmtools.GetNewUUID()
+    subject.DriverId = this.Id
+    subject.Value    = []byte(discoveryTopicValue)
+    subject.Type     = subjectTypeMqttTopic
+    subject.Enabled  = true
+    return subject
+}
+
+func (this *MG1DiscoveryDriver) SetDiscoveryHandler(onDiscover DiscoveryHandler) {
+    this.onDiscover = onDiscover
+}
+
+// ForgetGateway reports the gateway again when it is seen
+func (this *MG1DiscoveryDriver) ForgetGateway(mac string) {
+    this.Discovered.Forget(mac)
+}
+
+func (this *MG1DiscoveryDriver) newSubjectHandler(subject *Subject) (mqtrans.Handler, error) {
+    var err error
+    source := *subject
+    handler := func(topic string, payload []byte) {
+        mac := MacFromTopic(topic)
+        if len(mac) == 0 {
+            return
+        }
+        if !this.Discovered.Touch(mac, time.Now()) {
+            return
+        }
+        this.logger().Info("discovered gateway", "gateway", mac, "topic", topic)
+        if this.onDiscover != nil {
+            this.onDiscover(this.Id, mac, &source)
+        }
+    }
+    return handler, err
+}
+
+//
+// seenGateways
+//
+type seenGateways struct {
+    list    map[string]time.Time
+    mutex   sync.RWMutex
+}
+
+func newSeenGateways() *seenGateways {
+    var seen seenGateways
+    seen.list = make(map[string]time.Time)
+    return &seen
+}
+
+// Touch updates the last seen time and reports whether the mac is new
+func (this *seenGateways) Touch(mac string, at time.Time) bool {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    _, exists := this.list[mac]
+    this.list[mac] = at
+    return !exists
+}
+
+func (this *seenGateways) Forget(mac string) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    delete(this.list, mac)
+}
+
+func (this *seenGateways) MarshalJSON() ([]byte, error) {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    return json.Marshal(this.list)
+}
+//EOF
@@ -0,0 +1,158 @@
+
+package pmdrivers
+
+import (
+    "errors"
+    "fmt"
+    "regexp"
+    "sync"
+    "time"
+)
+
+//
+// MG1 payload validation
+//
+const (
+    minBeaconRssi       int = -127  // dBm
+    maxBeaconRssi       int = 20
+    minBeaconBattery    int = 0     // percent
+    maxBeaconBattery    int = 100
+
+    rejectLogPeriod     time.Duration = 10 * time.Second
+)
+
+var (
+    macPattern      = regexp.MustCompile(`^([0-9A-Fa-f]{2}:?){5}[0-9A-Fa-f]{2}$`)
+    mg1Codecs       = []string{ CodecJson, CodecMsgpack }
+)
+
+// mg1Record is the MG1 record as sent by the gateway, the timestamp
+// is kept as text, so every codec decodes the record directly
+type mg1Record struct {
+    Timestamp      string    `json:"timestamp"`
+    Type           string    `json:"type"`
+    Mac            string    `json:"mac"`
+    GatewayFree    int       `json:"gatewayFree"`
+    GatewayLoad    float64   `json:"gatewayLoad"`
+    Rssi           int       `json:"rssi"`
+    IbeaconUUID    string    `json:"ibeaconUUID"`
+    IbeaconMajor   int       `json:"ibeaconMajor"`
+    IbeaconMinor   int       `json:"ibeaconMinor"`
+    Battery        int       `json:"battery"`
+}
+
+func (this *mg1Record) toIBeacon() (IBeacon, error) {
+    var err error
+    beacon := IBeacon{
+        Type:           this.Type,
+        Mac:            this.Mac,
+        GatewayFree:    this.GatewayFree,
+        GatewayLoad:    this.GatewayLoad,
+        Rssi:           this.Rssi,
+        IbeaconUUID:    this.IbeaconUUID,
+        IbeaconMajor:   this.IbeaconMajor,
+        IbeaconMinor:   this.IbeaconMinor,
+        Battery:        this.Battery,
+    }
+    if len(this.Timestamp) > 0 {
+        beacon.Timestamp, err = time.Parse(time.RFC3339Nano, this.Timestamp)
+        if err != nil {
+            return beacon, fmt.Errorf("wrong timestamp %q", this.Timestamp)
+        }
+    }
+    return beacon, validateIBeacon(&beacon)
+}
+
+// rejectedRecord is the encoded record failed to decode or validate
+type rejectedRecord struct {
+    payload     []byte
+    err         error
+}
+
+// decodeMG1Payload checks the payload is an array of MG1 records
+// with required fields and sane values. Bad records are returned
+// as rejected, so the valid records of the payload are kept.
+func decodeMG1Payload(decoder Codec, payload []byte) ([]IBeacon, []rejectedRecord, error) {
+    var err error
+    iBeacons := make([]IBeacon, 0)
+    rejected := make([]rejectedRecord, 0)
+
+    arrayDecoder, ok := decoder.(ArrayCodec)
+    if !ok {
+        return nil, nil, fmt.Errorf("codec %s does not decode records", decoder.Name())
+    }
+    elements, err := arrayDecoder.SplitArray(payload)
+    if err != nil {
+        return nil, nil, fmt.Errorf("payload is not array of records: %s", err)
+    }
+    for i := range elements {
+        var record mg1Record
+        var beacon IBeacon
+        err = decoder.Decode(elements[i], &record)
+        if err == nil {
+            beacon, err = record.toIBeacon()
+        }
+        if err != nil {
+            rejected = append(rejected, rejectedRecord{
+                payload:    elements[i],
+                err:        fmt.Errorf("record %d: %s", i, err),
+            })
+            continue
+        }
+        iBeacons = append(iBeacons, beacon)
+    }
+    return iBeacons, rejected, nil
+}
+
+func validateIBeacon(beacon *IBeacon) error {
+    var err error
+    if len(beacon.Type) == 0 {
+        return errors.New("empty type")
+    }
+    if !macPattern.MatchString(beacon.Mac) {
+        return fmt.Errorf("wrong mac %q", beacon.Mac)
+    }
+    if beacon.Timestamp.IsZero() {
+        return errors.New("empty timestamp")
+    }
+    if beacon.Type == gatewayTypeLabel {
+        return err
+    }
+    if beacon.Rssi < minBeaconRssi || beacon.Rssi > maxBeaconRssi {
+        return fmt.Errorf("rssi %d out of range", beacon.Rssi)
+    }
+    if beacon.Battery < minBeaconBattery || beacon.Battery > maxBeaconBattery {
+        return fmt.Errorf("battery %d out of range", beacon.Battery)
+    }
+    return err
+}
+
+//
+// logSampler
+//
+// logSampler lets through one log line per period and
+// counts the suppressed ones
+type logSampler struct {
+    period      time.Duration
+    last        time.Time
+    suppressed  int
+    mutex       sync.Mutex
+}
+
+func newLogSampler(period time.Duration) *logSampler {
+    return &logSampler{ period: period }
+}
+
+func (this *logSampler) Allow(now time.Time) (bool, int) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    if now.Sub(this.last) < this.period {
+        this.suppressed++
+        return false, 0
+    }
+    suppressed := this.suppressed
+    this.last = now
+    this.suppressed = 0
+    return true, suppressed
+}
+//EOF
@@ -0,0 +1,156 @@
+package pmdrivers
+
+import (
+    "strings"
+    "testing"
+)
+
+func testRecord(mac string, rssi, battery int) map[string]interface{} {
+    return map[string]interface{}{
+        "timestamp":    "2021-05-20T13:55:00Z",
+        "type":         "iBeacon",
+        "mac":          mac,
+        "rssi":         rssi,
+        "battery":      battery,
+    }
+}
+
+func testGatewayRecord(mac string) map[string]interface{} {
+    return map[string]interface{}{
+        "timestamp":    "2021-05-20T13:55:00Z",
+        "type":         gatewayTypeLabel,
+        "mac":          mac,
+        "gatewayFree":  85,
+        "gatewayLoad":  0.25,
+    }
+}
+
+func TestDecodeMG1Payload(t *testing.T) {
+    tests := []struct {
+        name        string
+        records     []interface{}
+        accepted    []string    // macs
+        rejected    []string    // error parts
+    }{
+        {
+            name:       "valid batch",
+            records:    []interface{}{
+                testGatewayRecord("AC233FC0025F"),
+                testRecord("AC233FA00101", -60, 90),
+                testRecord("ac:23:3f:a0:01:02", -70, 80),
+            },
+            accepted:   []string{ "AC233FC0025F", "AC233FA00101", "ac:23:3f:a0:01:02" },
+        },
+        {
+            name:       "mixed batch",
+            records:    []interface{}{
+                testRecord("AC233FA00101", -60, 90),
+                testRecord("AC233FA0", -60, 90),
+                map[string]interface{}{ "type": "iBeacon", "mac": "AC233FA00103", "rssi": -60 },
+                map[string]interface{}{ "timestamp": "2021-05-20T13:55:00Z", "mac": "AC233FA00104" },
+                map[string]interface{}{ "timestamp": "20 May 2021", "type": "iBeacon", "mac": "AC233FA00105" },
+                map[string]interface{}{ "timestamp": "2021-05-20T13:55:00Z", "type": "iBeacon",
+                                        "mac": "AC233FA00106", "rssi": "strong" },
+                "not a record",
+                testRecord("AC233FA00107", -50, 100),
+            },
+            accepted:   []string{ "AC233FA00101", "AC233FA00107" },
+            rejected:   []string{ "record 1: wrong mac", "record 2: empty timestamp", "record 3: empty type",
+                                    "record 4: wrong timestamp", "record 5:", "record 6:" },
+        },
+        {
+            name:       "rssi range",
+            records:    []interface{}{
+                testRecord("AC233FA00101", -127, 50),
+                testRecord("AC233FA00102", 20, 50),
+                testRecord("AC233FA00103", -128, 50),
+                testRecord("AC233FA00104", 21, 50),
+            },
+            accepted:   []string{ "AC233FA00101", "AC233FA00102" },
+            rejected:   []string{ "record 2: rssi -128 out of range", "record 3: rssi 21 out of range" },
+        },
+        {
+            name:       "battery range",
+            records:    []interface{}{
+                testRecord("AC233FA00101", -60, 0),
+                testRecord("AC233FA00102", -60, 100),
+                testRecord("AC233FA00103", -60, -1),
+                testRecord("AC233FA00104", -60, 101),
+            },
+            accepted:   []string{ "AC233FA00101", "AC233FA00102" },
+            rejected:   []string{ "record 2: battery -1 out of range", "record 3: battery 101 out of range" },
+        },
+        {
+            name:       "gateway record has no rssi and battery",
+            records:    []interface{}{ testGatewayRecord("AC233FC0025F") },
+            accepted:   []string{ "AC233FC0025F" },
+        },
+        {
+            name:       "empty batch",
+            records:    []interface{}{},
+        },
+    }
+    for _, codecName := range []string{ CodecJson, CodecMsgpack } {
+        decoder, _ := GetCodec(codecName)
+        for _, test := range tests {
+            payload := encodePayload(t, codecName, test.records)
+            iBeacons, rejected, err := decodeMG1Payload(decoder, payload)
+            if err != nil {
+                t.Errorf("%s %s: unexpected error %s", codecName, test.name, err)
+                continue
+            }
+            if len(iBeacons) != len(test.accepted) {
+                t.Errorf("%s %s: got %d beacons, expected %d", codecName, test.name, len(iBeacons), len(test.accepted))
+                continue
+            }
+            for i := range iBeacons {
+                if iBeacons[i].Mac != test.accepted[i] {
+                    t.Errorf("%s %s: got beacon %s, expected %s", codecName, test.name, iBeacons[i].Mac, test.accepted[i])
+                }
+            }
+            if len(rejected) != len(test.rejected) {
+                t.Errorf("%s %s: got %d rejected, expected %d", codecName, test.name, len(rejected), len(test.rejected))
+                continue
+            }
+            for i := range rejected {
+                if !strings.HasPrefix(rejected[i].err.Error(), test.rejected[i]) {
+                    t.Errorf("%s %s: got error %q, expected %q", codecName, test.name, rejected[i].err, test.rejected[i])
+                }
+                if len(rejected[i].payload) == 0 {
+                    t.Errorf("%s %s: rejected record %d has no payload", codecName, test.name, i)
+                }
+            }
+        }
+    }
+}
+
+func TestDecodeMG1PayloadRejectsPayload(t *testing.T) {
+    tests := []struct {
+        codec       string
+        payload     []byte
+    }{
+        { codec: CodecJson,     payload: []byte(`{"type":"iBeacon"}`) },
+        { codec: CodecJson,     payload: []byte(`[{"type":`) },
+        { codec: CodecMsgpack,  payload: encodePayload(t, CodecMsgpack, testRecord("AC233FA00101", -60, 90)) },
+        { codec: CodecRaw,      payload: []byte(`[]`) },
+    }
+    for i, test := range tests {
+        decoder, _ := GetCodec(test.codec)
+        iBeacons, rejected, err := decodeMG1Payload(decoder, test.payload)
+        if err == nil || iBeacons != nil || rejected != nil {
+            t.Errorf("test %d: expected payload error, got %d beacons, %d rejected", i, len(iBeacons), len(rejected))
+        }
+    }
+}
+
+func TestDecodeMG1PayloadTimestamp(t *testing.T) {
+    payload := encodePayload(t, CodecMsgpack, []interface{}{ testRecord("AC233FA00101", -60, 90) })
+    iBeacons, _, err := decodeMG1Payload(NewMsgpackCodec(), payload)
+    if err != nil || len(iBeacons) != 1 {
+        t.Fatalf("unexpected result %v, %v", iBeacons, err)
+    }
+    if got := iBeacons[0].Timestamp.UTC().Format("2006-01-02T15:04:05Z"); got != "2021-05-20T13:55:00Z" {
+        t.Errorf("got timestamp %s", got)
+    }
+}
+//EOF
@@ -0,0 +1,143 @@
+
+package pmdrivers
+
+import (
+    "errors"
+    "fmt"
+    "net/url"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+//
+// ConfigSchema
+//
+type ConfigType string
+
+const (
+    ConfigTypeString    ConfigType = "string"
+    ConfigTypeInt       ConfigType = "int"
+    ConfigTypeBool      ConfigType = "bool"
+    ConfigTypeEnum      ConfigType = "enum"
+    ConfigTypeUrl       ConfigType = "url"
+    ConfigTypeTopic     ConfigType = "topic"
+)
+
+// ConfigSchema describes the config value, an empty value
+// is accepted unless the config is required
+type ConfigSchema struct {
+    Type        ConfigType  `json:"type"`
+    Required    bool        `json:"required"`
+    Default     string      `json:"default"`
+    Min         *int        `json:"min,omitempty"`
+    Max         *int        `json:"max,omitempty"`
+    Pattern     string      `json:"pattern,omitempty"`
+    Values      []string    `json:"values,omitempty"`     // enum values or url schemes
+    Secret      bool        `json:"secret"`
+    Description string      `json:"description"`
+}
+
+func intLimit(limit int) *int {
+    return &limit
+}
+
+func (this *ConfigSchema) Validate(value []byte) error {
+    var err error
+    text := string(value)
+    if len(text) == 0 {
+        if this.Required {
+            return errors.New("value is required")
+        }
+        return err
+    }
+
+    switch this.Type {
+        case ConfigTypeInt:
+            var number int
+            number, err = strconv.Atoi(text)
+            if err != nil {
+                return fmt.Errorf("%q is not integer", text)
+            }
+            if this.Min != nil && number < *this.Min {
+                return fmt.Errorf("%d is less than %d", number, *this.Min)
+            }
+            if this.Max != nil && number > *this.Max {
+                return fmt.Errorf("%d is greater than %d", number, *this.Max)
+            }
+        case ConfigTypeBool:
+            _, err = strconv.ParseBool(text)
+            if err != nil {
+                return fmt.Errorf("%q is not boolean", text)
+            }
+        case ConfigTypeEnum:
+            if !containsString(this.Values, text) {
+                return fmt.Errorf("%q is not one of %s", text, strings.Join(this.Values, ", "))
+            }
+        case ConfigTypeUrl:
+            var link *url.URL
+            link, err = url.Parse(text)
+            if err != nil {
+                return fmt.Errorf("wrong url: %s", err)
+            }
+            if len(this.Values) > 0 && !containsString(this.Values, link.Scheme) {
+                return fmt.Errorf("url scheme %q is not one of %s", link.Scheme, strings.Join(this.Values, ", "))
+            }
+            if len(link.Hostname()) == 0 {
+                return errors.New("url has no host")
+            }
+            if port := link.Port(); len(port) > 0 {
+                var number int
+                number, err = strconv.Atoi(port)
+                if err != nil || number < 1 || number > 65535 {
+                    return fmt.Errorf("wrong url port %q", port)
+                }
+            }
+        case ConfigTypeTopic:
+            if IsWildcardTopic(text) {
+                return fmt.Errorf("topic %q has wildcards", text)
+            }
+    }
+    if len(this.Pattern) > 0 {
+        var matched bool
+        matched, err = regexp.MatchString(this.Pattern, text)
+        if err != nil {
+            return fmt.Errorf("wrong schema pattern: %s", err)
+        }
+        if !matched {
+            return fmt.Errorf("%q does not match %s", text, this.Pattern)
+        }
+    }
+    return nil
+}
+
+func containsString(list []string, value string) bool {
+    for _, item := range list {
+        if item == value {
+            return true
+        }
+    }
+    return false
+}
+
+// ValidateConfigs checks all config values against their schemas
+// and reports all found problems at once
+func (this *MqttDriver) ValidateConfigs() error {
+    problems := make([]string, 0)
+    this.configMutex.RLock()
+    defer this.configMutex.RUnlock()
+    for _, config := range this.Configs {
+        if config.Schema == nil {
+            continue
+        }
+        err := config.Schema.Validate(config.Value)
+        if err != nil {
+            problems = append(problems, fmt.Sprintf("config %s: %s", config.Name, err))
+        }
+    }
+    if len(problems) > 0 {
+        return errors.New(strings.Join(problems, "; "))
+    }
+    return nil
+}
+//EOF
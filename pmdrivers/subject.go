@@ -0,0 +1,359 @@
+
+package pmdrivers
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+
+    "app/mqtrans"
+    "app/pmtools"
+)
+
+//
+// Runtime subjects
+//
+// SubjectHandlerFunc makes the transport handler of a subject,
+// drivers set it to route subject messages into own handlers
+type SubjectHandlerFunc = func(subject *Subject) (mqtrans.Handler, error)
+
+// topicHandlers are handlers of subjects sharing the topic,
+// the topic has one transport subscription while any of
+// the subjects is subscribed
+type topicHandlers map[*Subject]mqtrans.Handler
+
+// ValidateSubject checks the subject type, mqtt topic filter and codec
+func ValidateSubject(subject *Subject) error {
+    var err error
+    if subject.Type != subjectTypeMqttTopic {
+        return fmt.Errorf("unsupported subject type %q", subject.Type)
+    }
+    topic := string(subject.Value)
+    if len(topic) == 0 {
+        return errors.New("empty subject topic")
+    }
+    levels := strings.Split(topic, "/")
+    for i, level := range levels {
+        switch {
+            case level == "#" && i != len(levels) - 1:
+                return fmt.Errorf("wildcard # must be last in topic %q", topic)
+            case level != "+" && level != "#" && strings.ContainsAny(level, "+#"):
+                return fmt.Errorf("wildcard must occupy whole level in topic %q", topic)
+        }
+    }
+    _, err = GetCodec(subject.Codec)
+    return err
+}
+
+func IsWildcardTopic(topic string) bool {
+    return strings.ContainsAny(topic, "+#")
+}
+
+func (this *MqttDriver) hasWildcardSubject() bool {
+    this.subjectMutex.Lock()
+    defer this.subjectMutex.Unlock()
+    for i := range this.Subjects {
+        if this.Subjects[i].Enabled && IsWildcardTopic(string(this.Subjects[i].Value)) {
+            return true
+        }
+    }
+    return false
+}
+
+func (this *MqttDriver) SetSubjectHandler(newHandler SubjectHandlerFunc) {
+    this.newHandler = newHandler
+}
+
+// SetSubjectCodecs limits codecs of subjects to the ones the
+// driver handler decodes, no codecs mean any codec
+func (this *MqttDriver) SetSubjectCodecs(codecs ...string) {
+    this.codecs = codecs
+}
+
+// SetTopicValidator sets the driver specific check of subject
+// topics, e.g. the mac position of discovery topics
+func (this *MqttDriver) SetTopicValidator(checkTopic func(topic string) error) {
+    this.checkTopic = checkTopic
+}
+
+func (this *MqttDriver) validateSubject(subject *Subject) error {
+    var err error
+    err = ValidateSubject(subject)
+    if err != nil {
+        return err
+    }
+    if this.checkTopic != nil {
+        err = this.checkTopic(string(subject.Value))
+        if err != nil {
+            return err
+        }
+    }
+    if len(this.codecs) == 0 {
+        return err
+    }
+    name := subject.Codec
+    if len(name) == 0 {
+        name = CodecJson
+    }
+    for _, codec := range this.codecs {
+        if codec == name {
+            return err
+        }
+    }
+    return fmt.Errorf("codec %q is not supported by the driver, use %s",
+                        name, strings.Join(this.codecs, ", "))
+}
+
+func (this *MqttDriver) GetSubjects() []*Subject {
+    this.subjectMutex.Lock()
+    defer this.subjectMutex.Unlock()
+    result := make([]*Subject, 0, len(this.Subjects))
+    for i := range this.Subjects {
+        subject := *this.Subjects[i]
+        result = append(result, &subject)
+    }
+    return result
+}
+
+// ConnectSubjects subscribes all enabled subjects, later subject
+// changes are applied to the transport at once. A failed subject
+// does not prevent others from being subscribed, failed subjects
+// are returned as the error.
+func (this *MqttDriver) ConnectSubjects() error {
+    var err error
+    this.subjectMutex.Lock()
+    defer this.subjectMutex.Unlock()
+
+    this.connected = true
+    failed := make([]string, 0)
+    for i := range this.Subjects {
+        err = this.subscribeSubject(this.Subjects[i])
+        if err != nil {
+            this.logger().Warning("unable subscribe subject", "subject", this.Subjects[i].Name, "error", err)
+            failed = append(failed, this.Subjects[i].Name)
+        }
+    }
+    if len(failed) > 0 {
+        return fmt.Errorf("unable subscribe subjects %s", strings.Join(failed, ", "))
+    }
+    return nil
+}
+
+// DisconnectSubjects unsubscribes all subscribed topics
+func (this *MqttDriver) DisconnectSubjects() error {
+    var err error
+    this.subjectMutex.Lock()
+    defer this.subjectMutex.Unlock()
+
+    this.connected = false
+    for i := range this.Subjects {
+        err = this.unsubscribeSubject(this.Subjects[i])
+        if err != nil {
+            this.logger().Warning("unable unsubscribe subject", "subject", this.Subjects[i].Name, "error", err)
+        }
+    }
+    return nil
+}
+
+func (this *MqttDriver) subscribeSubject(subject *Subject) error {
+    var err error
+    if !this.connected || !subject.Enabled || subject.Type != subjectTypeMqttTopic {
+        return err
+    }
+    if this.newHandler == nil {
+        return errors.New("driver has no subject handler")
+    }
+    handler, err := this.newHandler(subject)
+    if err != nil {
+        return err
+    }
+    topic := string(subject.Value)
+
+    this.topicMutex.Lock()
+    handlers, shared := this.topics[topic]
+    if !shared {
+        handlers = make(topicHandlers)
+        this.topics[topic] = handlers
+    }
+    handlers[subject] = handler
+    this.topicMutex.Unlock()
+
+    if !shared {
+        err = this.mqt.Subscribe(topic, this.topicHandler(topic))
+        if err != nil {
+            this.topicMutex.Lock()
+            delete(this.topics, topic)
+            this.topicMutex.Unlock()
+            return err
+        }
+    }
+    this.subscribed[subject] = topic
+    this.logger().Debug("subscribed to topic", "subject", subject.Name, "topic", topic,
+                        "codec", subject.Codec, "shared", shared)
+    return err
+}
+
+// unsubscribeSubject unsubscribes the topic when no other
+// subject uses it
+func (this *MqttDriver) unsubscribeSubject(subject *Subject) error {
+    var err error
+    topic, exists := this.subscribed[subject]
+    if !exists {
+        return err
+    }
+    delete(this.subscribed, subject)
+
+    this.topicMutex.Lock()
+    handlers := this.topics[topic]
+    delete(handlers, subject)
+    last := len(handlers) == 0
+    if last {
+        delete(this.topics, topic)
+    }
+    this.topicMutex.Unlock()
+
+    if !last {
+        this.logger().Debug("subject left shared topic", "subject", subject.Name, "topic", topic)
+        return err
+    }
+    err = this.mqt.Unsubscribe(topic)
+    if err != nil {
+        return err
+    }
+    this.logger().Debug("unsubscribed from topic", "subject", subject.Name, "topic", topic)
+    return err
+}
+
+// moveSubscription hands the subscription of the replaced subject
+// over to the new one with the same topic, so it is unsubscribed
+// by the subject later. The handler is made for the new subject.
+func (this *MqttDriver) moveSubscription(current *Subject, subject *Subject) {
+    topic, exists := this.subscribed[current]
+    if !exists {
+        return
+    }
+    delete(this.subscribed, current)
+    this.subscribed[subject] = topic
+
+    rebuilt, err := this.newHandler(subject)
+
+    this.topicMutex.Lock()
+    defer this.topicMutex.Unlock()
+    handlers := this.topics[topic]
+    handler := handlers[current]
+    if err == nil {
+        handler = rebuilt
+    }
+    delete(handlers, current)
+    handlers[subject] = handler
+}
+
+// topicHandler passes topic messages to handlers of all
+// subjects subscribed to the topic
+func (this *MqttDriver) topicHandler(topic string) mqtrans.Handler {
+    return func(received string, payload []byte) {
+        this.topicMutex.RLock()
+        list := make([]mqtrans.Handler, 0, len(this.topics[topic]))
+        for _, handler := range this.topics[topic] {
+            list = append(list, handler)
+        }
+        this.topicMutex.RUnlock()
+        for _, handler := range list {
+            handler(received, payload)
+        }
+    }
+}
+
+func (this *MqttDriver) AddSubject(subject *Subject) (*Subject, error) {
+    var err error
+    if len(subject.Type) == 0 || subject.Type == subjectTypeUnknown {
+        subject.Type = subjectTypeMqttTopic
+    }
+    err = this.validateSubject(subject)
+    if err != nil {
+        return nil, err
+    }
+    item := *subject
+    item.Id         = pmtools.GetNewUUID()
+    item.DriverId   = this.Id
+
+    this.subjectMutex.Lock()
+    defer this.subjectMutex.Unlock()
+    err = this.subscribeSubject(&item)
+    if err != nil {
+        return nil, err
+    }
+    this.Subjects = append(this.Subjects, &item)
+
+    result := item
+    return &result, err
+}
+
+// UpdateSubject replaces the subject and resubscribes it
+// if the topic, codec or enabled state changed. The new topic
+// is subscribed first, so the subject is kept unchanged
+// when the subscription fails.
+func (this *MqttDriver) UpdateSubject(id string, subject *Subject) (*Subject, error) {
+    var err error
+    if len(subject.Type) == 0 || subject.Type == subjectTypeUnknown {
+        subject.Type = subjectTypeMqttTopic
+    }
+    err = this.validateSubject(subject)
+    if err != nil {
+        return nil, err
+    }
+
+    this.subjectMutex.Lock()
+    defer this.subjectMutex.Unlock()
+    for i := range this.Subjects {
+        if this.Subjects[i].Id != id {
+            continue
+        }
+        item := *subject
+        item.Id         = id
+        item.DriverId   = this.Id
+
+        current := this.Subjects[i]
+        changed := string(current.Value) != string(item.Value) ||
+                    current.Codec != item.Codec || current.Enabled != item.Enabled
+        if changed {
+            err = this.subscribeSubject(&item)
+            if err != nil {
+                return nil, err
+            }
+            // the subject is off the previous topic handlers
+            // even when the transport fails to unsubscribe
+            err = this.unsubscribeSubject(current)
+            if err != nil {
+                this.logger().Warning("unable unsubscribe previous topic", "subject", current.Name, "error", err)
+                err = nil
+            }
+        } else {
+            this.moveSubscription(current, &item)
+        }
+        this.Subjects[i] = &item
+
+        result := item
+        return &result, err
+    }
+    return nil, errors.New("subject not found")
+}
+
+func (this *MqttDriver) RemoveSubject(id string) error {
+    var err error
+    this.subjectMutex.Lock()
+    defer this.subjectMutex.Unlock()
+    for i := range this.Subjects {
+        if this.Subjects[i].Id != id {
+            continue
+        }
+        err = this.unsubscribeSubject(this.Subjects[i])
+        if err != nil {
+            return err
+        }
+        this.Subjects = append(this.Subjects[:i], this.Subjects[i + 1:]...)
+        return err
+    }
+    return errors.New("subject not found")
+}
+//EOF
@@ -0,0 +1,440 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmhistory
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "app/pmdrivers"
+    "app/pmtags"
+)
+
+const (
+    resolution  time.Duration = time.Minute
+    segmentSpan time.Duration = 24 * time.Hour
+    // samples of the recent window are kept in memory,
+    // older ones are read from segment files on query
+    memoryWindow time.Duration = time.Hour
+    fileMode    os.FileMode = 0640
+    dirMode     os.FileMode = 0750
+
+    segmentPrefix   string = "history-"
+    segmentSuffix   string = ".jsonl"
+    segmentLayout   string = "20060102"
+)
+
+//
+// Sample
+//
+type Sample struct {
+    Time        time.Time   `json:"time"`
+    Mac         string      `json:"mac"`
+    GatewayMac  string      `json:"gatewayMac"`
+    DriverId    string      `json:"driverId"`
+    Count       int         `json:"count"`
+    RssiMin     int         `json:"rssiMin"`
+    RssiMax     int         `json:"rssiMax"`
+    RssiAvg     float64     `json:"rssiAvg"`
+    Battery     int         `json:"battery"`
+}
+
+func NewSample(at time.Time, driverId, gatewayMac string, beacon *pmdrivers.IBeacon) *Sample {
+    return &Sample{
+        Time:       at,
+        Mac:        beacon.Mac,
+        GatewayMac: gatewayMac,
+        DriverId:   driverId,
+        Count:      1,
+        RssiMin:    beacon.Rssi,
+        RssiMax:    beacon.Rssi,
+        RssiAvg:    float64(beacon.Rssi),
+        Battery:    beacon.Battery,
+    }
+}
+
+func (this *Sample) add(beacon *pmdrivers.IBeacon) {
+    this.Count++
+    if beacon.Rssi < this.RssiMin {
+        this.RssiMin = beacon.Rssi
+    }
+    if beacon.Rssi > this.RssiMax {
+        this.RssiMax = beacon.Rssi
+    }
+    this.RssiAvg += (float64(beacon.Rssi) - this.RssiAvg) / float64(this.Count)
+    this.Battery = beacon.Battery
+}
+
+func (this *Sample) sameSlot(other *Sample) bool {
+    return this.Time.Equal(other.Time) && this.GatewayMac == other.GatewayMac &&
+                this.DriverId == other.DriverId
+}
+
+// merge adds the sample of the same minute written twice,
+// e.g. before and after a restart
+func (this *Sample) merge(other *Sample) {
+    count := this.Count + other.Count
+    if count == 0 {
+        return
+    }
+    this.RssiAvg = (this.RssiAvg * float64(this.Count) + other.RssiAvg * float64(other.Count)) / float64(count)
+    this.Count = count
+    if other.RssiMin < this.RssiMin {
+        this.RssiMin = other.RssiMin
+    }
+    if other.RssiMax > this.RssiMax {
+        this.RssiMax = other.RssiMax
+    }
+    this.Battery = other.Battery
+}
+
+//
+// Store
+//
+// Store keeps samples of the recent window in memory and appends
+// samples of passed minutes to daily segment files, older samples
+// are read from the files, expired segments are deleted as a whole
+type Store struct {
+    dir         string
+    retention   time.Duration
+    window      time.Duration
+    filter      pmdrivers.BeaconFilter
+    series      map[string][]*Sample
+    since       time.Time   // samples from since are in memory
+    pending     []*Sample
+    mutex       sync.RWMutex
+    fileMutex   sync.Mutex
+}
+
+func NewStore(dir string, retention time.Duration) *Store {
+    var store Store
+    store.dir       = dir
+    store.retention = retention
+    store.window    = memoryWindow
+    if retention < store.window {
+        store.window = retention
+    }
+    store.series    = make(map[string][]*Sample)
+    store.since     = time.Now().Truncate(resolution)
+    store.pending   = make([]*Sample, 0)
+    return &store
+}
+
+// SetFilter keeps denied tags out of the history
+func (this *Store) SetFilter(filter pmdrivers.BeaconFilter) {
+    this.filter = filter
+}
+
+// HandleBeacon aggregates the sighting into the per-minute
+// sample of the beacon and gateway
+func (this *Store) HandleBeacon(driverId string, gatewayMac string, beacon *pmdrivers.IBeacon) {
+    if this.filter != nil && this.filter.Denied(beacon) {
+        return
+    }
+    at := beacon.ReceivedAt
+    if at.IsZero() {
+        at = time.Now()
+    }
+    at = at.Truncate(resolution)
+    mac := pmtags.NormalizeMac(beacon.Mac)
+    gatewayMac = pmtags.NormalizeMac(gatewayMac)
+
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    samples := this.series[mac]
+    for i := len(samples) - 1; i >= 0 && samples[i].Time.Equal(at); i-- {
+        if samples[i].GatewayMac == gatewayMac && samples[i].DriverId == driverId {
+            samples[i].add(beacon)
+            return
+        }
+    }
+    sample := NewSample(at, driverId, gatewayMac, beacon)
+    sample.Mac = mac
+    this.series[mac] = append(samples, sample)
+    this.pending = append(this.pending, sample)
+}
+
+// Query returns samples of the beacon within [from, to] in time order,
+// optionally limited to one gateway. Samples before the memory window
+// are read from segment files.
+func (this *Store) Query(mac string, from, to time.Time, gatewayMac string) []*Sample {
+    mac = pmtags.NormalizeMac(mac)
+    gatewayMac = pmtags.NormalizeMac(gatewayMac)
+    from = from.Truncate(resolution)
+    if limit := time.Now().Add(-this.retention).Truncate(resolution); from.Before(limit) {
+        from = limit
+    }
+
+    this.mutex.RLock()
+    since := this.since
+    samples := this.series[mac]
+    first := sort.Search(len(samples), func(i int) bool {
+        return !samples[i].Time.Before(from)
+    })
+    recent := make([]*Sample, 0)
+    for i := first; i < len(samples) && !samples[i].Time.After(to); i++ {
+        if len(gatewayMac) > 0 && samples[i].GatewayMac != gatewayMac {
+            continue
+        }
+        sample := *samples[i]
+        recent = append(recent, &sample)
+    }
+    this.mutex.RUnlock()
+
+    if !from.Before(since) {
+        return recent
+    }
+    until := since
+    if to.Before(until) {
+        until = to.Add(resolution).Truncate(resolution)
+    }
+    result := this.scan(mac, gatewayMac, from, until)
+    return append(result, recent...)
+}
+
+// scan reads samples of the beacon within [from, until) from segment files
+func (this *Store) scan(mac, gatewayMac string, from, until time.Time) []*Sample {
+    series := make(map[string][]*Sample)
+    accept := func(sample *Sample) bool {
+        return sample.Mac == mac && !sample.Time.Before(from) && sample.Time.Before(until) &&
+                    (len(gatewayMac) == 0 || sample.GatewayMac == gatewayMac)
+    }
+    for _, segment := range this.segments() {
+        if !segment.start.Before(until) || !segment.start.Add(segmentSpan).After(from) {
+            continue
+        }
+        readSegment(segment.fileName, mac, accept, series)
+    }
+    result := series[mac]
+    if result == nil {
+        return make([]*Sample, 0)
+    }
+    sort.SliceStable(result, func(i, j int) bool {
+        return result[i].Time.Before(result[j].Time)
+    })
+    return result
+}
+
+// Expire drops samples older than the memory window
+// and segment files ended before the retention period
+func (this *Store) Expire() {
+    now := time.Now()
+    since := now.Add(-this.window).Truncate(resolution)
+
+    this.mutex.Lock()
+    this.since = since
+    for mac, samples := range this.series {
+        first := sort.Search(len(samples), func(i int) bool {
+            return !samples[i].Time.Before(since)
+        })
+        switch {
+            case first == len(samples):
+                delete(this.series, mac)
+            case first > 0:
+                this.series[mac] = append(make([]*Sample, 0, len(samples) - first), samples[first:]...)
+        }
+    }
+    this.mutex.Unlock()
+
+    limit := now.Add(-this.retention)
+    this.fileMutex.Lock()
+    defer this.fileMutex.Unlock()
+    for _, segment := range this.segments() {
+        if !segment.start.Add(segmentSpan).After(limit) {
+            os.Remove(segment.fileName)
+        }
+    }
+}
+
+// Save appends samples of passed minutes to segment files,
+// samples of the current minute are written by next save
+func (this *Store) Save() error {
+    return this.write(time.Now().Truncate(resolution))
+}
+
+// Close appends all samples not written yet
+func (this *Store) Close() error {
+    return this.write(time.Time{})
+}
+
+// write appends pending samples before the limit, the zero
+// limit writes all. Samples failed to write are kept pending.
+func (this *Store) write(limit time.Time) error {
+    var err error
+    this.fileMutex.Lock()
+    defer this.fileMutex.Unlock()
+
+    this.mutex.Lock()
+    lines := make(map[string][]byte)
+    samples := make(map[string][]*Sample)
+    kept := make([]*Sample, 0)
+    for _, sample := range this.pending {
+        if !limit.IsZero() && !sample.Time.Before(limit) {
+            kept = append(kept, sample)
+            continue
+        }
+        line, _ := json.Marshal(sample)
+        fileName := this.segmentName(sample.Time)
+        lines[fileName] = append(append(lines[fileName], line...), '\n')
+        samples[fileName] = append(samples[fileName], sample)
+    }
+    this.pending = kept
+    this.mutex.Unlock()
+
+    failed := make([]*Sample, 0)
+    for fileName, data := range lines {
+        writeErr := appendFile(fileName, data)
+        if writeErr != nil {
+            err = writeErr
+            failed = append(failed, samples[fileName]...)
+        }
+    }
+    if len(failed) > 0 {
+        this.mutex.Lock()
+        this.pending = append(failed, this.pending...)
+        this.mutex.Unlock()
+    }
+    return err
+}
+
+func appendFile(fileName string, data []byte) error {
+    file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, fileMode)
+    if err != nil {
+        return err
+    }
+    _, err = file.Write(data)
+    if err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+func (this *Store) segmentName(at time.Time) string {
+    return filepath.Join(this.dir, segmentPrefix + at.UTC().Format(segmentLayout) + segmentSuffix)
+}
+
+type segment struct {
+    fileName    string
+    start       time.Time
+}
+
+// segments returns segment files in time order
+func (this *Store) segments() []segment {
+    result := make([]segment, 0)
+    infos, err := ioutil.ReadDir(this.dir)
+    if err != nil {
+        return result
+    }
+    for _, info := range infos {
+        name := info.Name()
+        if info.IsDir() || !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+            continue
+        }
+        day := strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix)
+        start, err := time.ParseInLocation(segmentLayout, day, time.UTC)
+        if err != nil {
+            continue
+        }
+        result = append(result, segment{ fileName: filepath.Join(this.dir, name), start: start })
+    }
+    sort.Slice(result, func(i, j int) bool {
+        return result[i].start.Before(result[j].start)
+    })
+    return result
+}
+
+// Load reads samples of the memory window from segment files,
+// a broken line, e.g. of an interrupted write, is skipped
+func (this *Store) Load() error {
+    var err error
+    err = os.MkdirAll(this.dir, dirMode)
+    if err != nil {
+        return err
+    }
+    since := time.Now().Add(-this.window).Truncate(resolution)
+    accept := func(sample *Sample) bool {
+        return !sample.Time.Before(since)
+    }
+    series := make(map[string][]*Sample)
+    for _, segment := range this.segments() {
+        if !segment.start.Add(segmentSpan).After(since) {
+            continue
+        }
+        err = readSegment(segment.fileName, "", accept, series)
+        if err != nil {
+            return err
+        }
+    }
+    for _, samples := range series {
+        sort.SliceStable(samples, func(i, j int) bool {
+            return samples[i].Time.Before(samples[j].Time)
+        })
+    }
+
+    this.mutex.Lock()
+    this.series = series
+    this.since  = since
+    this.mutex.Unlock()
+
+    this.Expire()
+    return err
+}
+
+// readSegment adds accepted samples of the file to the series, samples
+// of the same slot written twice are merged. A not empty mac skips
+// lines of other beacons before they are decoded.
+func readSegment(fileName string, mac string, accept func(sample *Sample) bool, series map[string][]*Sample) error {
+    file, err := os.Open(fileName)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    var marker []byte
+    if len(mac) > 0 {
+        marker, _ = json.Marshal(map[string]string{ "mac": mac })
+        marker = bytes.Trim(marker, "{}")
+    }
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        line := scanner.Bytes()
+        if marker != nil && !bytes.Contains(line, marker) {
+            continue
+        }
+        sample := &Sample{}
+        if json.Unmarshal(line, sample) != nil {
+            continue
+        }
+        sample.Mac = pmtags.NormalizeMac(sample.Mac)
+        sample.GatewayMac = pmtags.NormalizeMac(sample.GatewayMac)
+        if !accept(sample) {
+            continue
+        }
+        samples := series[sample.Mac]
+        merged := false
+        for i := len(samples) - 1; i >= 0 && !samples[i].Time.Before(sample.Time); i-- {
+            if samples[i].sameSlot(sample) {
+                samples[i].merge(sample)
+                merged = true
+                break
+            }
+        }
+        if !merged {
+            series[sample.Mac] = append(samples, sample)
+        }
+    }
+    return scanner.Err()
+}
+//EOF
@@ -0,0 +1,113 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmlog
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "net"
+    "strings"
+    "sync"
+)
+
+//
+// journald sink, the native protocol of systemd-journald(8),
+// fields are upper case journal fields
+//
+const (
+    journalSocket   string = "/run/systemd/journal/socket"
+)
+
+type JournalSink struct {
+    appName     string
+    conn        *net.UnixConn
+    mutex       sync.Mutex
+}
+
+func NewJournalSink(appName string) (*JournalSink, error) {
+    addr := &net.UnixAddr{ Name: journalSocket, Net: "unixgram" }
+    conn, err := net.DialUnix("unixgram", nil, addr)
+    if err != nil {
+        return nil, fmt.Errorf("unable connect journal: %s", err)
+    }
+    sink := &JournalSink{
+        appName:    appName,
+        conn:       conn,
+    }
+    return sink, nil
+}
+
+func (this *JournalSink) WriteRecord(record *Record) error {
+    var buffer bytes.Buffer
+    writeJournalField(&buffer, "MESSAGE", record.Message)
+    writeJournalField(&buffer, "PRIORITY", fmt.Sprint(levelPriorities[record.Level]))
+    writeJournalField(&buffer, "SYSLOG_IDENTIFIER", this.appName)
+    writeJournalField(&buffer, "COMPONENT", record.Component)
+    for i := 0; i < len(record.Fields); i += 2 {
+        name := journalName(fieldKey(record.Fields, i))
+        writeJournalField(&buffer, name, fieldString(fieldValue(record.Fields, i)))
+    }
+
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    if this.conn == nil {
+        return fmt.Errorf("journal sink is closed")
+    }
+    _, err := this.conn.Write(buffer.Bytes())
+    return err
+}
+
+// writeJournalField uses the binary form for multiline values,
+// e.g. stack traces
+func writeJournalField(buffer *bytes.Buffer, name, value string) {
+    if !strings.Contains(value, "\n") {
+        buffer.WriteString(name)
+        buffer.WriteString("=")
+        buffer.WriteString(value)
+        buffer.WriteString("\n")
+        return
+    }
+    buffer.WriteString(name)
+    buffer.WriteString("\n")
+    binary.Write(buffer, binary.LittleEndian, uint64(len(value)))
+    buffer.WriteString(value)
+    buffer.WriteString("\n")
+}
+
+// journalName makes the field name of upper case letters, digits
+// and underscores, names can not start with underscore or digit
+func journalName(name string) string {
+    var builder strings.Builder
+    for _, char := range strings.ToUpper(name) {
+        if (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9') {
+            builder.WriteRune(char)
+            continue
+        }
+        builder.WriteRune('_')
+    }
+    result := strings.TrimLeft(builder.String(), "_0123456789")
+    if len(result) == 0 {
+        return "FIELD"
+    }
+    // the names of protocol fields are reserved
+    switch result {
+        case "MESSAGE", "PRIORITY", "SYSLOG_IDENTIFIER", "COMPONENT":
+            result = "PM_" + result
+    }
+    return result
+}
+
+func (this *JournalSink) Close() error {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    if this.conn == nil {
+        return nil
+    }
+    err := this.conn.Close()
+    this.conn = nil
+    return err
+}
+//EOF
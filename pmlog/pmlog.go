@@ -5,30 +5,341 @@
 package pmlog
 
 import (
+    "encoding/json"
+    "fmt"
     "log"
+    "strings"
+    "sync"
+    "time"
 )
 
+type Level int
+
+const (
+    LevelDebug      Level = iota
+    LevelInfo
+    LevelWarning
+    LevelError
+)
+
+const (
+    FormatText      string = "text"
+    FormatJson      string = "json"
+
+    DefaultComponent string = "app"
+)
+
+var levelNames = map[string]Level{
+    "debug":    LevelDebug,
+    "info":     LevelInfo,
+    "warning":  LevelWarning,
+    "error":    LevelError,
+}
+
+func (this Level) String() string {
+    for name, level := range levelNames {
+        if level == this {
+            return name
+        }
+    }
+    return fmt.Sprintf("level%d", int(this))
+}
+
+// settings are shared by all loggers and changed at runtime
+var settings = struct {
+    sync.RWMutex
+    level       Level
+    components  map[string]Level
+    format      string
+    output      sync.Mutex
+}{
+    level:      LevelDebug,
+    components: make(map[string]Level),
+    format:     FormatText,
+}
+
+func ParseLevel(name string) (Level, error) {
+    level, exists := levelNames[name]
+    if !exists {
+        return LevelDebug, fmt.Errorf("unknown log level %q", name)
+    }
+    return level, nil
+}
+
+// SetLevel drops messages below the level for components
+// without own level
+func SetLevel(name string) error {
+    level, err := ParseLevel(name)
+    if err != nil {
+        return err
+    }
+    settings.Lock()
+    settings.level = level
+    settings.Unlock()
+    return err
+}
+
+// SetComponentLevel overrides the level of the component,
+// the empty name removes the override
+func SetComponentLevel(component, name string) error {
+    var err error
+    settings.Lock()
+    defer settings.Unlock()
+    if len(name) == 0 {
+        delete(settings.components, component)
+        return err
+    }
+    level, err := ParseLevel(name)
+    if err != nil {
+        return err
+    }
+    settings.components[component] = level
+    return err
+}
+
+// SetComponentLevels replaces all component overrides
+func SetComponentLevels(levels map[string]string) error {
+    components := make(map[string]Level)
+    for component, name := range levels {
+        level, err := ParseLevel(name)
+        if err != nil {
+            return fmt.Errorf("component %s: %s", component, err)
+        }
+        components[component] = level
+    }
+    settings.Lock()
+    settings.components = components
+    settings.Unlock()
+    return nil
+}
+
+func ParseFormat(name string) (string, error) {
+    switch name {
+        case FormatText, FormatJson:
+            return name, nil
+    }
+    return FormatText, fmt.Errorf("unknown log format %q", name)
+}
+
+func SetFormat(name string) error {
+    format, err := ParseFormat(name)
+    if err != nil {
+        return err
+    }
+    settings.Lock()
+    settings.format = format
+    settings.Unlock()
+    return err
+}
+
+// Levels describes the current log settings
+type Levels struct {
+    Level       string              `json:"level"`
+    Format      string              `json:"format"`
+    Components  map[string]string   `json:"components"`
+}
+
+func GetLevels() Levels {
+    settings.RLock()
+    defer settings.RUnlock()
+    levels := Levels{
+        Level:      settings.level.String(),
+        Format:     settings.format,
+        Components: make(map[string]string),
+    }
+    for component, level := range settings.components {
+        levels.Components[component] = level.String()
+    }
+    return levels
+}
+
+//
+// Logger
+//
+// Logger writes messages of the component with key-value fields,
+// e.g. NewLogger("drivers").With("driver", id).Info("loop started")
+type Logger struct {
+    component   string
+    fields      []interface{}
+}
+
+func NewLogger(component string) *Logger {
+    return &Logger{
+        component:  component,
+        fields:     make([]interface{}, 0),
+    }
+}
+
+// With returns the logger with added key-value fields
+func (this *Logger) With(keyvals ...interface{}) *Logger {
+    fields := make([]interface{}, 0, len(this.fields) + len(keyvals))
+    fields = append(fields, this.fields...)
+    fields = append(fields, keyvals...)
+    return &Logger{
+        component:  this.component,
+        fields:     fields,
+    }
+}
+
+// Enabled allows to skip costly message preparation
+func (this *Logger) Enabled(level Level) bool {
+    settings.RLock()
+    defer settings.RUnlock()
+    threshold, exists := settings.components[this.component]
+    if !exists {
+        threshold = settings.level
+    }
+    return level >= threshold
+}
+
+func (this *Logger) Debug(message string, keyvals ...interface{}) {
+    this.write(LevelDebug, message, keyvals)
+}
+
+func (this *Logger) Info(message string, keyvals ...interface{}) {
+    this.write(LevelInfo, message, keyvals)
+}
+
+func (this *Logger) Warning(message string, keyvals ...interface{}) {
+    this.write(LevelWarning, message, keyvals)
+}
+
+// Error messages are never dropped
+func (this *Logger) Error(message string, keyvals ...interface{}) {
+    this.write(LevelError, message, keyvals)
+}
+
+func (this *Logger) write(level Level, message string, keyvals []interface{}) {
+    if level < LevelError && !this.Enabled(level) {
+        return
+    }
+    fields := make([]interface{}, 0, len(this.fields) + len(keyvals))
+    fields = append(fields, this.fields...)
+    fields = append(fields, keyvals...)
+
+    settings.RLock()
+    format := settings.format
+    settings.RUnlock()
+
+    if format == FormatJson {
+        this.writeJson(level, message, fields)
+    } else {
+        this.writeText(level, message, fields)
+    }
+    record := &Record{
+        Time:       time.Now(),
+        Level:      level,
+        Component:  this.component,
+        Message:    message,
+        Fields:     fields,
+    }
+    writeRing(record)
+    writeSinks(record)
+}
+
+func (this *Logger) writeText(level Level, message string, fields []interface{}) {
+    var builder strings.Builder
+    builder.WriteString(level.String())
+    builder.WriteString(": ")
+    builder.WriteString(message)
+    if this.component != DefaultComponent {
+        builder.WriteString(" component=")
+        builder.WriteString(this.component)
+    }
+    for i := 0; i < len(fields); i += 2 {
+        builder.WriteString(" ")
+        builder.WriteString(fieldKey(fields, i))
+        builder.WriteString("=")
+        builder.WriteString(quoteValue(fieldValue(fields, i)))
+    }
+    log.Println(builder.String())
+}
+
+func (this *Logger) writeJson(level Level, message string, fields []interface{}) {
+    record := make(map[string]interface{})
+    for i := 0; i < len(fields); i += 2 {
+        value := fieldValue(fields, i)
+        if err, ok := value.(error); ok {
+            value = err.Error()
+        }
+        record[fieldKey(fields, i)] = value
+    }
+    record["time"]      = time.Now().Format(time.RFC3339Nano)
+    record["level"]     = level.String()
+    record["component"] = this.component
+    record["message"]   = message
+
+    line, err := json.Marshal(record)
+    if err != nil {
+        line, _ = json.Marshal(map[string]interface{}{
+            "time":     record["time"],
+            "level":    record["level"],
+            "message":  message,
+            "error":    err.Error(),
+        })
+    }
+    line = append(line, '\n')
+    settings.output.Lock()
+    log.Writer().Write(line)
+    settings.output.Unlock()
+}
+
+func fieldKey(fields []interface{}, i int) string {
+    key, ok := fields[i].(string)
+    if !ok {
+        return fmt.Sprint(fields[i])
+    }
+    return key
+}
+
+func fieldValue(fields []interface{}, i int) interface{} {
+    if i + 1 >= len(fields) {
+        return "(missing)"
+    }
+    return fields[i + 1]
+}
+
+func quoteValue(value interface{}) string {
+    text := fmt.Sprint(value)
+    if len(text) == 0 || strings.ContainsAny(text, " \t\n\"=") {
+        return fmt.Sprintf("%q", text)
+    }
+    return text
+}
+
+//
+// Package level functions log messages of the default
+// component, message parts are joined by spaces
+//
+var defaultLogger = NewLogger(DefaultComponent)
+
+func joinMessage(message []interface{}) string {
+    return strings.TrimSuffix(fmt.Sprintln(message...), "\n")
+}
+
 func LogDebug(message ...interface{}) {
-    log.Println("debug:", message)
-    return
+    if !defaultLogger.Enabled(LevelDebug) {
+        return
+    }
+    defaultLogger.Debug(joinMessage(message))
 }
 
 func LogError(message ...interface{}) {
-    log.Println("error:", message)
-    return
+    defaultLogger.Error(joinMessage(message))
 }
 
-
 func LogWarning(message ...interface{}) {
-    log.Println("warning:", message)
-    return
+    if !defaultLogger.Enabled(LevelWarning) {
+        return
+    }
+    defaultLogger.Warning(joinMessage(message))
 }
 
 func LogInfo(message ...interface{}) {
-    log.Println("info:", message)
-    return
+    if !defaultLogger.Enabled(LevelInfo) {
+        return
+    }
+    defaultLogger.Info(joinMessage(message))
 }
 
 //EOF
-
-
@@ -0,0 +1,199 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmlog
+
+import (
+    "sync"
+    "time"
+)
+
+const (
+    DefaultBufferSize   int = 1000
+    subscriberQueueSize int = 256
+)
+
+// Entry is the log record kept in the ring buffer,
+// the sequence number lets clients continue the tail
+type Entry struct {
+    Seq         uint64              `json:"seq"`
+    Time        time.Time           `json:"time"`
+    Level       string              `json:"level"`
+    Component   string              `json:"component"`
+    Message     string              `json:"message"`
+    Fields      map[string]string   `json:"fields,omitempty"`
+    level       Level
+}
+
+// EntryFilter selects entries, zero values match all
+type EntryFilter struct {
+    Level       Level               // minimal level
+    Component   string
+    Driver      string              // value of the driver field
+    Since       uint64              // entries after the sequence number
+    Limit       int                 // last entries only
+}
+
+func (this *EntryFilter) Match(entry *Entry) bool {
+    if entry.level < this.Level {
+        return false
+    }
+    if entry.Seq <= this.Since {
+        return false
+    }
+    if len(this.Component) > 0 && entry.Component != this.Component {
+        return false
+    }
+    if len(this.Driver) > 0 && entry.Fields["driver"] != this.Driver {
+        return false
+    }
+    return true
+}
+
+// Subscription receives new entries, entries are dropped
+// while the queue is full, the sequence gap shows the loss
+type Subscription struct {
+    Entries     chan *Entry
+    filter      EntryFilter
+}
+
+var ring = struct {
+    sync.Mutex
+    entries     []*Entry
+    next        int
+    count       int
+    seq         uint64
+    subscribers map[*Subscription]bool
+}{
+    entries:        make([]*Entry, DefaultBufferSize),
+    subscribers:    make(map[*Subscription]bool),
+}
+
+// SetBufferSize resizes the ring buffer keeping the last
+// entries, zero size disables the buffer
+func SetBufferSize(size int) {
+    if size < 0 {
+        size = 0
+    }
+    ring.Lock()
+    defer ring.Unlock()
+    if size == len(ring.entries) {
+        return
+    }
+    kept := ringEntries()
+    if len(kept) > size {
+        kept = kept[len(kept) - size:]
+    }
+    ring.entries = make([]*Entry, size)
+    copy(ring.entries, kept)
+    ring.count = len(kept)
+    ring.next = 0
+    if size > 0 {
+        ring.next = len(kept) % size
+    }
+}
+
+// Entries returns buffered entries selected by the filter, oldest first
+func Entries(filter EntryFilter) []*Entry {
+    ring.Lock()
+    all := ringEntries()
+    ring.Unlock()
+
+    result := make([]*Entry, 0)
+    for _, entry := range all {
+        if filter.Match(entry) {
+            result = append(result, entry)
+        }
+    }
+    if filter.Limit > 0 && len(result) > filter.Limit {
+        result = result[len(result) - filter.Limit:]
+    }
+    return result
+}
+
+// Subscribe returns buffered entries selected by the filter
+// and the subscription to following entries
+func Subscribe(filter EntryFilter) ([]*Entry, *Subscription) {
+    subscription := &Subscription{
+        Entries:    make(chan *Entry, subscriberQueueSize),
+        filter:     filter,
+    }
+    subscription.filter.Limit = 0
+
+    ring.Lock()
+    all := ringEntries()
+    ring.subscribers[subscription] = true
+    ring.Unlock()
+
+    backlog := make([]*Entry, 0)
+    for _, entry := range all {
+        if filter.Match(entry) {
+            backlog = append(backlog, entry)
+        }
+    }
+    if filter.Limit > 0 && len(backlog) > filter.Limit {
+        backlog = backlog[len(backlog) - filter.Limit:]
+    }
+    return backlog, subscription
+}
+
+// Unsubscribe stops the subscription and closes its channel
+func Unsubscribe(subscription *Subscription) {
+    ring.Lock()
+    defer ring.Unlock()
+    if ring.subscribers[subscription] {
+        delete(ring.subscribers, subscription)
+        close(subscription.Entries)
+    }
+}
+
+// ringEntries returns entries oldest first, the ring must be locked
+func ringEntries() []*Entry {
+    size := len(ring.entries)
+    result := make([]*Entry, 0, ring.count)
+    for i := 0; i < ring.count; i++ {
+        index := (ring.next - ring.count + i + size) % size
+        result = append(result, ring.entries[index])
+    }
+    return result
+}
+
+func writeRing(record *Record) {
+    entry := &Entry{
+        Time:       record.Time,
+        Level:      record.Level.String(),
+        Component:  record.Component,
+        Message:    record.Message,
+        level:      record.Level,
+    }
+    if len(record.Fields) > 0 {
+        entry.Fields = make(map[string]string)
+        for i := 0; i < len(record.Fields); i += 2 {
+            entry.Fields[fieldKey(record.Fields, i)] = fieldString(fieldValue(record.Fields, i))
+        }
+    }
+
+    ring.Lock()
+    defer ring.Unlock()
+    ring.seq++
+    entry.Seq = ring.seq
+    size := len(ring.entries)
+    if size > 0 {
+        ring.entries[ring.next] = entry
+        ring.next = (ring.next + 1) % size
+        if ring.count < size {
+            ring.count++
+        }
+    }
+    for subscription := range ring.subscribers {
+        if !subscription.filter.Match(entry) {
+            continue
+        }
+        select {
+            case subscription.Entries <- entry:
+            default:
+        }
+    }
+}
+//EOF
@@ -0,0 +1,275 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmlog
+
+import (
+    "compress/gzip"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+const (
+    compressSuffix  string = ".gz"
+    logdirMode      os.FileMode = 0750
+)
+
+// RotateConfig describes the rotation of the log file, zero
+// MaxSize or Period disables the rotation by size or by time
+type RotateConfig struct {
+    MaxSize     int64           // bytes
+    Period      time.Duration   // periods are aligned to UTC
+    Keep        int             // count of rotated files
+    Compress    bool
+}
+
+// RotatingFile is the log file rotated to name.1, name.2 ...
+// with optional gzip compression, Reopen supports external
+// rotation like logrotate or newsyslog
+type RotatingFile struct {
+    filename    string
+    mode        os.FileMode
+    config      RotateConfig
+    file        *os.File
+    size        int64
+    openedAt    time.Time
+    mutex       sync.Mutex
+    shiftMutex  sync.Mutex      // guards names of rotated files
+    shifts      int64           // count of shifts, rotated files move by one
+    compressMutex sync.Mutex    // one compression at a time
+}
+
+func OpenRotatingFile(filename string, mode os.FileMode, config RotateConfig) (*RotatingFile, error) {
+    if config.Keep < 1 {
+        config.Keep = 1
+    }
+    rotating := &RotatingFile{
+        filename:   filename,
+        mode:       mode,
+        config:     config,
+    }
+    err := os.MkdirAll(filepath.Dir(filename), logdirMode)
+    if err != nil {
+        return nil, err
+    }
+    err = rotating.open()
+    if err != nil {
+        return nil, err
+    }
+    return rotating, nil
+}
+
+func (this *RotatingFile) Name() string {
+    return this.filename
+}
+
+// open appends to the existing file, the modification time
+// keeps the period of the file over restarts
+func (this *RotatingFile) open() error {
+    file, err := os.OpenFile(this.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, this.mode)
+    if err != nil {
+        return err
+    }
+    info, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return err
+    }
+    this.file     = file
+    this.size     = info.Size()
+    this.openedAt = time.Now()
+    if info.Size() > 0 {
+        this.openedAt = info.ModTime()
+    }
+    return err
+}
+
+func (this *RotatingFile) Write(data []byte) (int, error) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    if this.file == nil {
+        return 0, os.ErrClosed
+    }
+    if this.needRotate(int64(len(data)), time.Now()) {
+        err := this.rotate()
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "unable rotate log", this.filename, "error:", err)
+        }
+        if this.file == nil {
+            return 0, err
+        }
+    }
+    written, err := this.file.Write(data)
+    this.size += int64(written)
+    return written, err
+}
+
+func (this *RotatingFile) needRotate(next int64, now time.Time) bool {
+    if this.size == 0 {
+        return false
+    }
+    if this.config.MaxSize > 0 && this.size + next > this.config.MaxSize {
+        return true
+    }
+    if this.config.Period > 0 && !now.UTC().Truncate(this.config.Period).Equal(
+                        this.openedAt.UTC().Truncate(this.config.Period)) {
+        return true
+    }
+    return false
+}
+
+// Rotate rotates the file at once
+func (this *RotatingFile) Rotate() error {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    if this.file == nil {
+        return os.ErrClosed
+    }
+    return this.rotate()
+}
+
+// rotate takes the shift lock only while files are renamed,
+// so writes do not wait for a running compression
+func (this *RotatingFile) rotate() error {
+    var err error
+    this.shiftMutex.Lock()
+    err = this.shift()
+    if err != nil {
+        this.shiftMutex.Unlock()
+        return err
+    }
+    this.shifts++
+    this.file.Close()
+    this.file = nil
+    err = os.Rename(this.filename, this.rotatedName(1, false))
+    this.shiftMutex.Unlock()
+    openErr := this.open()
+    if openErr != nil {
+        return openErr
+    }
+    if err != nil {
+        return err
+    }
+    if this.config.Compress {
+        go this.compressRotated()
+    }
+    return err
+}
+
+// shift renames name.N to name.N+1 and removes files
+// above the retention count
+func (this *RotatingFile) shift() error {
+    keep := this.config.Keep
+    for _, compressed := range []bool{ false, true } {
+        os.Remove(this.rotatedName(keep, compressed))
+    }
+    for i := keep - 1; i > 0; i-- {
+        for _, compressed := range []bool{ false, true } {
+            err := os.Rename(this.rotatedName(i, compressed), this.rotatedName(i + 1, compressed))
+            if err != nil && !os.IsNotExist(err) {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+func (this *RotatingFile) rotatedName(index int, compressed bool) string {
+    name := fmt.Sprintf("%s.%d", this.filename, index)
+    if compressed {
+        name += compressSuffix
+    }
+    return name
+}
+
+// compressRotated compresses all rotated files left
+// uncompressed, so overlapped rotations miss no file
+func (this *RotatingFile) compressRotated() {
+    this.compressMutex.Lock()
+    defer this.compressMutex.Unlock()
+    for i := 1; i <= this.config.Keep; i++ {
+        this.shiftMutex.Lock()
+        shifts := this.shifts
+        source, err := os.Open(this.rotatedName(i, false))
+        this.shiftMutex.Unlock()
+        if err != nil {
+            continue
+        }
+        err = this.compressFile(source, i, shifts)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "unable compress log", source.Name(), "error:", err)
+        }
+    }
+}
+
+// compressFile compresses the rotated file to a temporary name
+// without the shift lock, the result is renamed to the place
+// the file was shifted to meanwhile
+func (this *RotatingFile) compressFile(source *os.File, index int, shifts int64) error {
+    defer source.Close()
+    target, err := ioutil.TempFile(filepath.Dir(this.filename),
+                        filepath.Base(this.filename) + ".*" + compressSuffix + ".tmp")
+    if err != nil {
+        return err
+    }
+    writer := gzip.NewWriter(target)
+    _, err = io.Copy(writer, source)
+    if err == nil {
+        err = writer.Close()
+    }
+    closeErr := target.Close()
+    if err == nil {
+        err = closeErr
+    }
+    if err == nil {
+        err = os.Chmod(target.Name(), this.mode)
+    }
+    if err != nil {
+        os.Remove(target.Name())
+        return err
+    }
+
+    this.shiftMutex.Lock()
+    defer this.shiftMutex.Unlock()
+    index += int(this.shifts - shifts)
+    if index > this.config.Keep {
+        // the file is removed by the retention meanwhile
+        return os.Remove(target.Name())
+    }
+    err = os.Rename(target.Name(), this.rotatedName(index, true))
+    if err != nil {
+        os.Remove(target.Name())
+        return err
+    }
+    return os.Remove(this.rotatedName(index, false))
+}
+
+// Reopen opens the file again after it was moved by
+// external rotation
+func (this *RotatingFile) Reopen() error {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    if this.file != nil {
+        this.file.Close()
+        this.file = nil
+    }
+    return this.open()
+}
+
+func (this *RotatingFile) Close() error {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    if this.file == nil {
+        return nil
+    }
+    err := this.file.Close()
+    this.file = nil
+    return err
+}
+//EOF
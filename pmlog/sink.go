@@ -0,0 +1,122 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmlog
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "sync"
+    "time"
+)
+
+const (
+    SinkFile        string = "file"
+    SinkSyslog      string = "syslog"
+    SinkJournald    string = "journald"
+)
+
+// Record is the log message passed to sinks
+type Record struct {
+    Time        time.Time
+    Level       Level
+    Component   string
+    Message     string
+    Fields      []interface{}   // key-value pairs
+}
+
+// Sink receives log records in addition to the standard
+// logger output, which is the message file and stdout
+type Sink interface {
+    WriteRecord(record *Record) error
+    Close() error
+}
+
+// levelPriorities are syslog severities of levels
+var levelPriorities = map[Level]int{
+    LevelDebug:     7,
+    LevelInfo:      6,
+    LevelWarning:   4,
+    LevelError:     3,
+}
+
+var sinks = struct {
+    sync.RWMutex
+    list        []Sink
+    failed      map[Sink]bool
+}{
+    list:       make([]Sink, 0),
+    failed:     make(map[Sink]bool),
+}
+
+// ParseSink checks the sink name
+func ParseSink(name string) (string, error) {
+    switch name {
+        case SinkFile, SinkSyslog, SinkJournald:
+            return name, nil
+    }
+    return name, fmt.Errorf("unknown log sink %q", name)
+}
+
+// OpenSink opens the syslog or journald sink, the file
+// sink is the standard logger output and has no Sink
+func OpenSink(name string) (Sink, error) {
+    switch name {
+        case SinkSyslog:
+            return NewSyslogSink(appName())
+        case SinkJournald:
+            return NewJournalSink(appName())
+    }
+    return nil, fmt.Errorf("log sink %q can not be opened", name)
+}
+
+// SetSinks replaces sinks, previous sinks are closed
+func SetSinks(list ...Sink) {
+    sinks.Lock()
+    previous := sinks.list
+    sinks.list = list
+    sinks.failed = make(map[Sink]bool)
+    sinks.Unlock()
+    for _, sink := range previous {
+        sink.Close()
+    }
+}
+
+// writeSinks reports the first failure of the sink to stderr,
+// the failure is not reported again until the sink recovers
+func writeSinks(record *Record) {
+    sinks.RLock()
+    list := sinks.list
+    sinks.RUnlock()
+    for _, sink := range list {
+        err := sink.WriteRecord(record)
+        sinks.RLock()
+        reported := sinks.failed[sink]
+        sinks.RUnlock()
+        if (err != nil) == reported {
+            continue
+        }
+        sinks.Lock()
+        sinks.failed[sink] = err != nil
+        sinks.Unlock()
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "unable write log sink:", err)
+        }
+    }
+}
+
+func appName() string {
+    return filepath.Base(os.Args[0])
+}
+
+// fieldString turns the field value into text, errors
+// give their message
+func fieldString(value interface{}) string {
+    if err, ok := value.(error); ok {
+        return err.Error()
+    }
+    return fmt.Sprint(value)
+}
+//EOF
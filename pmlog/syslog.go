@@ -0,0 +1,142 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmlog
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "strings"
+    "sync"
+)
+
+//
+// Local syslog sink, messages are RFC 5424 formatted
+// with fields as structured data
+//
+const (
+    syslogFacility      int = 3         // daemon
+    syslogDataId        string = "pmapp@32473"
+    syslogMaxNameLen    int = 32
+    // TIME-SECFRAC of RFC 5424 has at most 6 digits
+    syslogTimeLayout    string = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+var syslogPaths = []string{ "/dev/log", "/var/run/syslog", "/var/run/log" }
+
+type SyslogSink struct {
+    appName     string
+    hostname    string
+    conn        net.Conn
+    mutex       sync.Mutex
+}
+
+func NewSyslogSink(appName string) (*SyslogSink, error) {
+    hostname, _ := os.Hostname()
+    if len(hostname) == 0 {
+        hostname = "-"
+    }
+    sink := &SyslogSink{
+        appName:    appName,
+        hostname:   hostname,
+    }
+    err := sink.connect()
+    if err != nil {
+        return nil, err
+    }
+    return sink, nil
+}
+
+func (this *SyslogSink) connect() error {
+    var err error
+    for _, path := range syslogPaths {
+        for _, network := range []string{ "unixgram", "unix" } {
+            var conn net.Conn
+            conn, err = net.Dial(network, path)
+            if err == nil {
+                this.conn = conn
+                return nil
+            }
+        }
+    }
+    return fmt.Errorf("unable connect local syslog: %s", err)
+}
+
+// WriteRecord reconnects once, the syslog daemon may be restarted
+func (this *SyslogSink) WriteRecord(record *Record) error {
+    message := this.format(record)
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    if this.conn != nil {
+        _, err := this.conn.Write([]byte(message))
+        if err == nil {
+            return err
+        }
+        this.conn.Close()
+        this.conn = nil
+    }
+    err := this.connect()
+    if err != nil {
+        return err
+    }
+    _, err = this.conn.Write([]byte(message))
+    return err
+}
+
+// format makes the message
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ID name="value"] MSG
+func (this *SyslogSink) format(record *Record) string {
+    priority := syslogFacility * 8 + levelPriorities[record.Level]
+    var builder strings.Builder
+    fmt.Fprintf(&builder, "<%d>1 %s %s %s %d %s ",
+                        priority, record.Time.Format(syslogTimeLayout), this.hostname,
+                        this.appName, os.Getpid(), syslogName(record.Component))
+
+    builder.WriteString("[")
+    builder.WriteString(syslogDataId)
+    for i := 0; i < len(record.Fields); i += 2 {
+        fmt.Fprintf(&builder, " %s=\"%s\"", syslogName(fieldKey(record.Fields, i)),
+                        syslogEscape(fieldString(fieldValue(record.Fields, i))))
+    }
+    builder.WriteString("] ")
+    builder.WriteString(record.Message)
+    return builder.String()
+}
+
+func (this *SyslogSink) Close() error {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    if this.conn == nil {
+        return nil
+    }
+    err := this.conn.Close()
+    this.conn = nil
+    return err
+}
+
+// syslogName keeps printable ascii without '=', ' ', ']', '"'
+func syslogName(name string) string {
+    var builder strings.Builder
+    for _, char := range name {
+        if char <= ' ' || char > '~' || char == '=' || char == ']' || char == '"' {
+            char = '_'
+        }
+        builder.WriteRune(char)
+    }
+    result := builder.String()
+    if len(result) == 0 {
+        return "-"
+    }
+    if len(result) > syslogMaxNameLen {
+        result = result[:syslogMaxNameLen]
+    }
+    return result
+}
+
+func syslogEscape(value string) string {
+    replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+    return replacer.Replace(value)
+}
+//EOF
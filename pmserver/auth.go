@@ -0,0 +1,77 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmserver
+
+import (
+    "crypto/subtle"
+    "errors"
+    "net/http"
+    "net/url"
+    "strings"
+
+    "github.com/gin-gonic/gin"
+)
+
+const (
+    bearerPrefix    string = "Bearer "
+    // browsers can not set headers of websocket requests,
+    // the websocket routes take the token as the parameter
+    tokenParam      string = "access_token"
+    tokenMask       string = "masked"
+)
+
+// SetToken sets the token of "Authorization: Bearer <token>"
+// required by calls changing the state and reading logs,
+// the calls are refused while the token is not set
+func (this *Server) SetToken(token string) {
+    this.token = token
+}
+
+func (this *Server) authorize(c *gin.Context) {
+    header := c.GetHeader("Authorization")
+    this.checkToken(c, strings.TrimPrefix(header, bearerPrefix), strings.HasPrefix(header, bearerPrefix))
+}
+
+// authorizeSocket takes the token of the header or of the
+// access_token parameter, e.g. /logging/tail?access_token=TOKEN
+func (this *Server) authorizeSocket(c *gin.Context) {
+    header := c.GetHeader("Authorization")
+    if len(header) > 0 {
+        this.checkToken(c, strings.TrimPrefix(header, bearerPrefix), strings.HasPrefix(header, bearerPrefix))
+        return
+    }
+    token := c.Query(tokenParam)
+    this.checkToken(c, token, len(token) > 0)
+}
+
+func (this *Server) checkToken(c *gin.Context, token string, present bool) {
+    if len(this.token) == 0 {
+        sendError(c, http.StatusForbidden, errors.New("api token is not configured"))
+        c.Abort()
+        return
+    }
+    if !present || subtle.ConstantTimeCompare([]byte(token), []byte(this.token)) != 1 {
+        c.Header("WWW-Authenticate", "Bearer")
+        sendError(c, http.StatusUnauthorized, errors.New("unauthorized"))
+        c.Abort()
+        return
+    }
+    c.Next()
+}
+
+// maskToken hides the access_token parameter of the logged path
+func maskToken(path string) string {
+    index := strings.Index(path, "?")
+    if index < 0 {
+        return path
+    }
+    query, err := url.ParseQuery(path[index + 1:])
+    if err != nil || len(query.Get(tokenParam)) == 0 {
+        return path
+    }
+    query.Set(tokenParam, tokenMask)
+    return path[:index + 1] + query.Encode()
+}
+//EOF
@@ -0,0 +1,45 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmserver
+
+import (
+    "errors"
+    "net/http"
+    "strconv"
+
+    "github.com/gin-gonic/gin"
+)
+
+const (
+    defaultAlertLimit   int = 100
+)
+
+// ListBatteries returns all tags sorted by battery level, lowest first
+func (this *Server) ListBatteries(c *gin.Context) {
+    if this.battery == nil {
+        sendError(c, http.StatusNotFound, errors.New("battery monitor is not enabled"))
+        return
+    }
+    sendResult(c, this.battery.Report())
+}
+
+// ListAlerts returns recent alerts, newest first, e.g. /alerts?limit=10
+func (this *Server) ListAlerts(c *gin.Context) {
+    if this.alerter == nil {
+        sendError(c, http.StatusNotFound, errors.New("alerts are not enabled"))
+        return
+    }
+    limit := defaultAlertLimit
+    if param := c.Query("limit"); len(param) > 0 {
+        var err error
+        limit, err = strconv.Atoi(param)
+        if err != nil {
+            sendError(c, http.StatusBadRequest, err)
+            return
+        }
+    }
+    sendResult(c, this.alerter.Recent(limit))
+}
+//EOF
@@ -0,0 +1,68 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmserver
+
+import (
+    "errors"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+)
+
+func (this *Server) checkDiscovery(c *gin.Context) bool {
+    if this.discovery == nil {
+        sendError(c, http.StatusNotFound, errors.New("gateway discovery is not enabled"))
+        return false
+    }
+    return true
+}
+
+func (this *Server) ListDiscovered(c *gin.Context) {
+    if !this.checkDiscovery(c) {
+        return
+    }
+    sendResult(c, this.discovery.List())
+}
+
+func (this *Server) ApproveGateway(c *gin.Context) {
+    if !this.checkDiscovery(c) {
+        return
+    }
+    mac := c.Param("mac")
+    err := this.discovery.Approve(mac)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    sendResult(c, gin.H{ "mac": mac })
+}
+
+func (this *Server) RejectGateway(c *gin.Context) {
+    if !this.checkDiscovery(c) {
+        return
+    }
+    mac := c.Param("mac")
+    err := this.discovery.Reject(mac)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    sendResult(c, gin.H{ "mac": mac })
+}
+
+// RemoveGateway stops serving the gateway and forgets it
+func (this *Server) RemoveGateway(c *gin.Context) {
+    if !this.checkDiscovery(c) {
+        return
+    }
+    mac := c.Param("mac")
+    err := this.discovery.Remove(mac)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    sendResult(c, gin.H{ "mac": mac })
+}
+//EOF
@@ -0,0 +1,188 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmserver
+
+import (
+    "errors"
+    "io/ioutil"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+
+    "app/pmdrivers"
+)
+
+func (this *Server) findDriver(id string) (pmdrivers.Driverer, error) {
+    drivers := this.drivers.Drivers()
+    for i := range drivers {
+        if drivers[i].GetId() == id {
+            return drivers[i], nil
+        }
+    }
+    return nil, errors.New("driver not found")
+}
+
+func (this *Server) ListDrivers(c *gin.Context) {
+    sendResult(c, this.drivers.Drivers())
+}
+
+func (this *Server) GetDriver(c *gin.Context) {
+    driver, err := this.findDriver(c.Param("id"))
+    if err != nil {
+        sendError(c, http.StatusNotFound, err)
+        return
+    }
+    sendResult(c, driver)
+}
+
+// GetDriverStatus returns the lifecycle state of the driver
+func (this *Server) GetDriverStatus(c *gin.Context) {
+    driver, err := this.findDriver(c.Param("id"))
+    if err != nil {
+        sendError(c, http.StatusNotFound, err)
+        return
+    }
+    sendResult(c, driver.GetStatus())
+}
+
+// ListConfigs returns driver configs with their schemas,
+// values of secret configs are masked
+func (this *Server) ListConfigs(c *gin.Context) {
+    driver, err := this.findDriver(c.Param("id"))
+    if err != nil {
+        sendError(c, http.StatusNotFound, err)
+        return
+    }
+    sendResult(c, driver.GetConfigs())
+}
+
+// SetConfig passes the request body as the config value,
+// the value is checked against the config schema and stored
+// by the driver under its config lock, then applied by the
+// configurer, e.g. the changed broker url restarts the driver
+func (this *Server) SetConfig(c *gin.Context) {
+    driver, err := this.findDriver(c.Param("id"))
+    if err != nil {
+        sendError(c, http.StatusNotFound, err)
+        return
+    }
+    value, err := ioutil.ReadAll(c.Request.Body)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    if this.configurer != nil {
+        err = this.configurer.ConfigureDriver(driver, c.Param("name"), value)
+    } else {
+        err = driver.SetConfig(c.Param("name"), value)
+    }
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    sendResult(c, gin.H{ "name": c.Param("name") })
+}
+
+// ListDeadLetters returns payloads rejected by the driver, newest first
+func (this *Server) ListDeadLetters(c *gin.Context) {
+    driver, err := this.findDriver(c.Param("id"))
+    if err != nil {
+        sendError(c, http.StatusNotFound, err)
+        return
+    }
+    letterer, ok := driver.(pmdrivers.DeadLetterer)
+    if !ok {
+        sendError(c, http.StatusNotFound, errors.New("driver does not keep dead letters"))
+        return
+    }
+    sendResult(c, letterer.DeadLetters())
+}
+
+// ExecControl passes the request body as the control value to
+// the gateway given by mac, the mac may be omitted for drivers
+// serving a single gateway, e.g.
+// POST /drivers/:id/controls/UploadInterval?gateway=ac233fc0025f with body "5"
+func (this *Server) ExecControl(c *gin.Context) {
+    driver, err := this.findDriver(c.Param("id"))
+    if err != nil {
+        sendError(c, http.StatusNotFound, err)
+        return
+    }
+    value, err := ioutil.ReadAll(c.Request.Body)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    requestId, err := driver.ExecControl(c.Param("name"), c.Query("gateway"), value)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    sendResult(c, gin.H{ "requestId": requestId })
+}
+
+func (this *Server) ListSubjects(c *gin.Context) {
+    driver, err := this.findDriver(c.Param("id"))
+    if err != nil {
+        sendError(c, http.StatusNotFound, err)
+        return
+    }
+    sendResult(c, driver.GetSubjects())
+}
+
+func (this *Server) CreateSubject(c *gin.Context) {
+    driver, err := this.findDriver(c.Param("id"))
+    if err != nil {
+        sendError(c, http.StatusNotFound, err)
+        return
+    }
+    subject := pmdrivers.NewSubject()
+    err = c.ShouldBindJSON(subject)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    subject, err = driver.AddSubject(subject)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    sendResult(c, subject)
+}
+
+func (this *Server) UpdateSubject(c *gin.Context) {
+    driver, err := this.findDriver(c.Param("id"))
+    if err != nil {
+        sendError(c, http.StatusNotFound, err)
+        return
+    }
+    subject := pmdrivers.NewSubject()
+    err = c.ShouldBindJSON(subject)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    subject, err = driver.UpdateSubject(c.Param("sid"), subject)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    sendResult(c, subject)
+}
+
+func (this *Server) DeleteSubject(c *gin.Context) {
+    driver, err := this.findDriver(c.Param("id"))
+    if err != nil {
+        sendError(c, http.StatusNotFound, err)
+        return
+    }
+    err = driver.RemoveSubject(c.Param("sid"))
+    if err != nil {
+        sendError(c, http.StatusNotFound, err)
+        return
+    }
+    sendResult(c, gin.H{ "id": c.Param("sid") })
+}
+//EOF
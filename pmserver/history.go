@@ -0,0 +1,55 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmserver
+
+import (
+    "errors"
+    "net/http"
+    "time"
+
+    "github.com/gin-gonic/gin"
+
+    "app/pmtags"
+)
+
+const (
+    defaultHistorySpan  time.Duration = time.Hour
+)
+
+// GetBeaconHistory returns per-minute samples of the beacon, macs
+// are matched in any case and with or without separators, e.g. /beacons/:mac/history?from=2021-05-20T13:55:00Z&to=2021-05-20T14:05:00Z&gateway=ac233fc0025f
+func (this *Server) GetBeaconHistory(c *gin.Context) {
+    var err error
+
+    if this.history == nil {
+        sendError(c, http.StatusNotFound, errors.New("history is not enabled"))
+        return
+    }
+
+    to := time.Now()
+    if param := c.Query("to"); len(param) > 0 {
+        to, err = time.Parse(time.RFC3339, param)
+        if err != nil {
+            sendError(c, http.StatusBadRequest, err)
+            return
+        }
+    }
+    from := to.Add(-defaultHistorySpan)
+    if param := c.Query("from"); len(param) > 0 {
+        from, err = time.Parse(time.RFC3339, param)
+        if err != nil {
+            sendError(c, http.StatusBadRequest, err)
+            return
+        }
+    }
+    if from.After(to) {
+        sendError(c, http.StatusBadRequest, errors.New("from is after to"))
+        return
+    }
+    mac := pmtags.NormalizeMac(c.Param("mac"))
+    gatewayMac := pmtags.NormalizeMac(c.Query("gateway"))
+    sendResult(c, this.history.Query(mac, from, to, gatewayMac))
+}
+//EOF
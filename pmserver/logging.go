@@ -0,0 +1,171 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmserver
+
+import (
+    "io/ioutil"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+
+    "app/pmlog"
+)
+
+// GetLogging returns the log level, format and levels of components
+func (this *Server) GetLogging(c *gin.Context) {
+    sendResult(c, pmlog.GetLevels())
+}
+
+// SetLogLevel changes the log level at runtime,
+// e.g. PUT /logging/level with body "debug"
+func (this *Server) SetLogLevel(c *gin.Context) {
+    value, err := ioutil.ReadAll(c.Request.Body)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    err = pmlog.SetLevel(strings.TrimSpace(string(value)))
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    sendResult(c, pmlog.GetLevels())
+}
+
+// SetComponentLevel overrides the level of the component,
+// the empty body removes the override
+func (this *Server) SetComponentLevel(c *gin.Context) {
+    value, err := ioutil.ReadAll(c.Request.Body)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    err = pmlog.SetComponentLevel(c.Param("name"), strings.TrimSpace(string(value)))
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    sendResult(c, pmlog.GetLevels())
+}
+
+const (
+    tailWriteTimeout    time.Duration = 10 * time.Second
+    tailPingPeriod      time.Duration = 30 * time.Second
+)
+
+var tailUpgrader = websocket.Upgrader{
+    ReadBufferSize:     1024,
+    WriteBufferSize:    4096,
+}
+
+// ListLogRecords returns buffered log records, oldest first,
+// e.g. /logging/records?level=warning&driver=ID&limit=100
+func (this *Server) ListLogRecords(c *gin.Context) {
+    filter, err := entryFilter(c)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    sendResult(c, pmlog.Entries(filter))
+}
+
+// TailLog sends buffered and following log records as json
+// messages over the websocket, filters are the same as of
+// ListLogRecords, the since parameter resumes the tail. Browsers
+// pass the api token as the access_token parameter.
+func (this *Server) TailLog(c *gin.Context) {
+    filter, err := entryFilter(c)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    conn, err := tailUpgrader.Upgrade(c.Writer, c.Request, nil)
+    if err != nil {
+        pmlog.LogWarning("unable upgrade log tail connection:", err)
+        return
+    }
+    defer conn.Close()
+
+    backlog, subscription := pmlog.Subscribe(filter)
+    defer pmlog.Unsubscribe(subscription)
+
+    // the reader detects the closed connection, client
+    // messages are ignored
+    closed := make(chan struct{})
+    go func() {
+        defer close(closed)
+        for {
+            _, _, err := conn.ReadMessage()
+            if err != nil {
+                return
+            }
+        }
+    }()
+
+    send := func(entry *pmlog.Entry) error {
+        conn.SetWriteDeadline(time.Now().Add(tailWriteTimeout))
+        return conn.WriteJSON(entry)
+    }
+    for _, entry := range backlog {
+        if send(entry) != nil {
+            return
+        }
+    }
+    ticker := time.NewTicker(tailPingPeriod)
+    defer ticker.Stop()
+    for {
+        select {
+            case entry, ok := <- subscription.Entries:
+                if !ok || send(entry) != nil {
+                    return
+                }
+            case <- ticker.C:
+                err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(tailWriteTimeout))
+                if err != nil {
+                    return
+                }
+            case <- this.done:
+                conn.WriteControl(websocket.CloseMessage,
+                        websocket.FormatCloseMessage(websocket.CloseGoingAway, "server stopped"),
+                        time.Now().Add(tailWriteTimeout))
+                return
+            case <- closed:
+                return
+        }
+    }
+}
+
+// entryFilter reads level, component, driver, since and limit
+func entryFilter(c *gin.Context) (pmlog.EntryFilter, error) {
+    var err error
+    var filter pmlog.EntryFilter
+    filter.Level = pmlog.LevelDebug
+    if param := c.Query("level"); len(param) > 0 {
+        filter.Level, err = pmlog.ParseLevel(param)
+        if err != nil {
+            return filter, err
+        }
+    }
+    filter.Component = c.Query("component")
+    filter.Driver = c.Query("driver")
+    if param := c.Query("since"); len(param) > 0 {
+        filter.Since, err = strconv.ParseUint(param, 10, 64)
+        if err != nil {
+            return filter, err
+        }
+    }
+    if param := c.Query("limit"); len(param) > 0 {
+        filter.Limit, err = strconv.Atoi(param)
+        if err != nil {
+            return filter, err
+        }
+    }
+    return filter, err
+}
+//EOF
@@ -0,0 +1,218 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmserver
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+
+    "app/pmalert"
+    "app/pmbattery"
+    "app/pmdiscovery"
+    "app/pmdrivers"
+    "app/pmhistory"
+    "app/pmlog"
+    "app/pmsupervisor"
+    "app/pmtags"
+)
+
+const (
+    apiPrefix   string = "/api/v1"
+)
+
+// DriverSource gives the server access to the running drivers
+type DriverSource interface {
+    Drivers() []pmdrivers.Driverer
+}
+
+// DriverConfigurer applies configs changed through the api
+// to the running driver the way the application does
+type DriverConfigurer interface {
+    ConfigureDriver(driver pmdrivers.Driverer, name string, value []byte) error
+}
+
+type Server struct {
+    listen      string
+    engine      *gin.Engine
+    server      *http.Server
+    listener    net.Listener
+    done        chan struct{}
+
+    drivers     DriverSource
+    configurer  DriverConfigurer
+    history     *pmhistory.Store
+    battery     *pmbattery.Monitor
+    alerter     *pmalert.Alerter
+    tags        *pmtags.Registry
+    discovery   *pmdiscovery.Registry
+    supervisor  *pmsupervisor.Supervisor
+    token       string
+}
+
+func NewServer(listen string) *Server {
+    var server Server
+    server.listen = listen
+    server.done = make(chan struct{})
+
+    gin.SetMode(gin.ReleaseMode)
+    server.engine = gin.New()
+    server.engine.Use(gin.Recovery())
+    return &server
+}
+
+func (this *Server) SetDriverSource(drivers DriverSource) {
+    this.drivers = drivers
+}
+
+func (this *Server) SetDriverConfigurer(configurer DriverConfigurer) {
+    this.configurer = configurer
+}
+
+func (this *Server) SetHistory(history *pmhistory.Store) {
+    this.history = history
+}
+
+func (this *Server) SetBattery(battery *pmbattery.Monitor) {
+    this.battery = battery
+}
+
+func (this *Server) SetAlerter(alerter *pmalert.Alerter) {
+    this.alerter = alerter
+}
+
+func (this *Server) SetTags(tags *pmtags.Registry) {
+    this.tags = tags
+}
+
+func (this *Server) SetDiscovery(discovery *pmdiscovery.Registry) {
+    this.discovery = discovery
+}
+
+func (this *Server) SetSupervisor(supervisor *pmsupervisor.Supervisor) {
+    this.supervisor = supervisor
+}
+
+// SetAccessLog writes requests in the combined log format,
+// it must be called before Start
+func (this *Server) SetAccessLog(writer io.Writer) {
+    formatter := func(param gin.LogFormatterParams) string {
+        return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\" %s\n",
+            param.ClientIP,
+            param.TimeStamp.Format("02/Jan/2006:15:04:05 -0700"),
+            param.Method,
+            maskToken(param.Path),
+            param.Request.Proto,
+            param.StatusCode,
+            param.BodySize,
+            param.Request.Referer(),
+            param.Request.UserAgent(),
+            param.Latency,
+        )
+    }
+    this.engine.Use(gin.LoggerWithConfig(gin.LoggerConfig{
+        Formatter:  formatter,
+        Output:     writer,
+    }))
+}
+
+// SetListener sets the bound listener, e.g. the socket
+// passed by socket activation
+func (this *Server) SetListener(listener net.Listener) {
+    this.listener = listener
+    this.listen = listener.Addr().String()
+}
+
+// Listen binds the listen address before the server start,
+// so privileged ports are bound before privilege dropping
+func (this *Server) Listen() error {
+    var err error
+    if this.listener != nil {
+        return err
+    }
+    this.listener, err = net.Listen("tcp", this.listen)
+    if err != nil {
+        return fmt.Errorf("unable listen %s: %s", this.listen, err)
+    }
+    return err
+}
+
+func (this *Server) Start() error {
+    var err error
+    err = this.Listen()
+    if err != nil {
+        return err
+    }
+
+    api := this.engine.Group(apiPrefix)
+    api.GET("/drivers", this.ListDrivers)
+    api.GET("/drivers/:id", this.GetDriver)
+    api.GET("/drivers/:id/status", this.GetDriverStatus)
+    api.GET("/supervisor", this.ListSupervised)
+    api.GET("/drivers/:id/configs", this.ListConfigs)
+    api.GET("/drivers/:id/subjects", this.ListSubjects)
+    api.GET("/beacons/:mac/history", this.GetBeaconHistory)
+    api.GET("/batteries", this.ListBatteries)
+    api.GET("/alerts", this.ListAlerts)
+    api.GET("/tags", this.ListTags)
+    api.GET("/tags/:id", this.GetTag)
+    api.GET("/discovery", this.ListDiscovered)
+    api.GET("/logging", this.GetLogging)
+
+    admin := api.Group("", this.authorize)
+    admin.POST("/drivers/:id/restart", this.RestartDriver)
+    admin.PUT("/drivers/:id/configs/:name", this.SetConfig)
+    admin.POST("/drivers/:id/controls/:name", this.ExecControl)
+    admin.GET("/drivers/:id/deadletters", this.ListDeadLetters)
+    admin.POST("/drivers/:id/subjects", this.CreateSubject)
+    admin.PUT("/drivers/:id/subjects/:sid", this.UpdateSubject)
+    admin.DELETE("/drivers/:id/subjects/:sid", this.DeleteSubject)
+    admin.POST("/tags", this.CreateTag)
+    admin.PUT("/tags/:id", this.UpdateTag)
+    admin.DELETE("/tags/:id", this.DeleteTag)
+    admin.POST("/discovery/:mac/approve", this.ApproveGateway)
+    admin.POST("/discovery/:mac/reject", this.RejectGateway)
+    admin.DELETE("/discovery/:mac", this.RemoveGateway)
+    admin.PUT("/logging/level", this.SetLogLevel)
+    admin.PUT("/logging/components/:name", this.SetComponentLevel)
+    admin.GET("/logging/records", this.ListLogRecords)
+    api.GET("/logging/tail", this.authorizeSocket, this.TailLog)
+
+    this.server = &http.Server{
+        Addr:       this.listen,
+        Handler:    this.engine,
+    }
+    go func() {
+        pmlog.LogInfo("web server listen on", this.listen)
+        err := this.server.Serve(this.listener)
+        if err != nil && err != http.ErrServerClosed {
+            pmlog.LogError("web server error:", err)
+        }
+    }()
+    return err
+}
+
+// Stop closes log tails too, hijacked websocket
+// connections are not closed by the shutdown
+func (this *Server) Stop(ctx context.Context) error {
+    if this.server == nil {
+        return nil
+    }
+    close(this.done)
+    return this.server.Shutdown(ctx)
+}
+
+func sendResult(c *gin.Context, result interface{}) {
+    c.JSON(http.StatusOK, result)
+}
+
+func sendError(c *gin.Context, code int, err error) {
+    c.JSON(code, gin.H{ "error": err.Error() })
+}
+//EOF
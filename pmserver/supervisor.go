@@ -0,0 +1,44 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmserver
+
+import (
+    "errors"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+)
+
+func (this *Server) checkSupervisor(c *gin.Context) bool {
+    if this.supervisor == nil {
+        sendError(c, http.StatusNotFound, errors.New("driver supervisor is not enabled"))
+        return false
+    }
+    return true
+}
+
+// ListSupervised returns restart counters and quarantine
+// flags of all drivers
+func (this *Server) ListSupervised(c *gin.Context) {
+    if !this.checkSupervisor(c) {
+        return
+    }
+    sendResult(c, this.supervisor.List())
+}
+
+// RestartDriver restarts the driver, a quarantined driver is released
+func (this *Server) RestartDriver(c *gin.Context) {
+    if !this.checkSupervisor(c) {
+        return
+    }
+    id := c.Param("id")
+    err := this.supervisor.Restart(id)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    sendResult(c, gin.H{ "id": id })
+}
+//EOF
@@ -0,0 +1,102 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmserver
+
+import (
+    "errors"
+    "net/http"
+
+    "github.com/gin-gonic/gin"
+
+    "app/pmtags"
+)
+
+func (this *Server) checkTags(c *gin.Context) bool {
+    if this.tags == nil {
+        sendError(c, http.StatusNotFound, errors.New("tag registry is not enabled"))
+        return false
+    }
+    return true
+}
+
+// tagErrorCode tells missing tags, rejected tags
+// and tags failed to save
+func tagErrorCode(err error) int {
+    switch {
+        case errors.Is(err, pmtags.ErrNotFound):
+            return http.StatusNotFound
+        case errors.Is(err, pmtags.ErrSave):
+            return http.StatusInternalServerError
+    }
+    return http.StatusBadRequest
+}
+
+func (this *Server) ListTags(c *gin.Context) {
+    if !this.checkTags(c) {
+        return
+    }
+    sendResult(c, this.tags.List())
+}
+
+func (this *Server) GetTag(c *gin.Context) {
+    if !this.checkTags(c) {
+        return
+    }
+    tag, err := this.tags.Get(c.Param("id"))
+    if err != nil {
+        sendError(c, http.StatusNotFound, err)
+        return
+    }
+    sendResult(c, tag)
+}
+
+func (this *Server) CreateTag(c *gin.Context) {
+    if !this.checkTags(c) {
+        return
+    }
+    tag := pmtags.NewTag()
+    err := c.ShouldBindJSON(tag)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    tag, err = this.tags.Add(tag)
+    if err != nil {
+        sendError(c, tagErrorCode(err), err)
+        return
+    }
+    sendResult(c, tag)
+}
+
+func (this *Server) UpdateTag(c *gin.Context) {
+    if !this.checkTags(c) {
+        return
+    }
+    tag := pmtags.NewTag()
+    err := c.ShouldBindJSON(tag)
+    if err != nil {
+        sendError(c, http.StatusBadRequest, err)
+        return
+    }
+    tag, err = this.tags.Update(c.Param("id"), tag)
+    if err != nil {
+        sendError(c, tagErrorCode(err), err)
+        return
+    }
+    sendResult(c, tag)
+}
+
+func (this *Server) DeleteTag(c *gin.Context) {
+    if !this.checkTags(c) {
+        return
+    }
+    err := this.tags.Delete(c.Param("id"))
+    if err != nil {
+        sendError(c, tagErrorCode(err), err)
+        return
+    }
+    sendResult(c, gin.H{ "id": c.Param("id") })
+}
+//EOF
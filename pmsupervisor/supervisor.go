@@ -0,0 +1,428 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmsupervisor
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math/rand"
+    "runtime/debug"
+    "sync"
+    "time"
+
+    "app/pmalert"
+    "app/pmdrivers"
+    "app/pmlog"
+)
+
+const (
+    watchPeriod     time.Duration = 1 * time.Second
+
+    minBackoff      time.Duration = 1 * time.Second
+    maxBackoff      time.Duration = 5 * time.Minute
+    backoffJitter   float64       = 0.2
+
+    // a driver running longer than stablePeriod starts
+    // the backoff from the beginning after next failure
+    stablePeriod    time.Duration = 1 * time.Minute
+
+    // a driver crashed or failed after successful start flapLimit
+    // times within flapWindow is quarantined until released by
+    // operator, failed connects are only backed off
+    flapWindow      time.Duration = 10 * time.Minute
+    flapLimit       int           = 5
+
+    alertSource     string = "supervisor"
+)
+
+var logger = pmlog.NewLogger("supervisor")
+
+//
+// Supervision
+//
+// Supervision is the supervisor view of a driver
+type Supervision struct {
+    DriverId    string                  `json:"driverId"`
+    State       pmdrivers.DriverState   `json:"state"`
+    Restarts    int                     `json:"restarts"`
+    Attempt     int                     `json:"attempt"`
+    NextRestart time.Time               `json:"nextRestart"`
+    Quarantined bool                    `json:"quarantined"`
+    LastError   string                  `json:"lastError"`
+}
+
+type entry struct {
+    driver      pmdrivers.Driverer
+    starting    bool
+    removed     bool        // removed while starting, is not started again
+    crashed     bool        // panic out of the driver lifecycle call
+    startedAt   time.Time   // last start by supervisor
+    attempt     int
+    restarts    int
+    failures    []time.Time
+    nextRestart time.Time
+    quarantined bool
+    lastError   string
+}
+
+//
+// Supervisor
+//
+// Supervisor starts drivers independently and restarts
+// failed ones with exponential backoff
+type Supervisor struct {
+    entries     []*entry
+    alerter     *pmalert.Alerter
+    closed      bool
+    mutex       sync.RWMutex
+    started     *sync.Cond  // signals the end of driver starts
+    wg          sync.WaitGroup
+}
+
+func NewSupervisor(alerter *pmalert.Alerter) *Supervisor {
+    var supervisor Supervisor
+    supervisor.entries = make([]*entry, 0)
+    supervisor.alerter = alerter
+    supervisor.started = sync.NewCond(&supervisor.mutex)
+    return &supervisor
+}
+
+// Add registers the driver and starts it in background
+func (this *Supervisor) Add(driver pmdrivers.Driverer) {
+    item := &entry{ driver: driver, failures: make([]time.Time, 0) }
+    this.mutex.Lock()
+    if this.closed {
+        this.mutex.Unlock()
+        logger.Warning("supervisor is stopped, driver is not started", "driver", driver.GetId())
+        return
+    }
+    this.entries = append(this.entries, item)
+    item.starting = true
+    this.mutex.Unlock()
+    this.startDriver(item)
+}
+
+// Remove stops the driver and forgets it, the driver being
+// started is stopped after the start is finished
+func (this *Supervisor) Remove(driverId string) error {
+    this.mutex.Lock()
+    var item *entry
+    for i := range this.entries {
+        if this.entries[i].driver.GetId() == driverId {
+            item = this.entries[i]
+            this.entries = append(this.entries[:i], this.entries[i + 1:]...)
+            break
+        }
+    }
+    if item == nil {
+        this.mutex.Unlock()
+        return errors.New("driver not found")
+    }
+    item.removed = true
+    for item.starting {
+        this.started.Wait()
+    }
+    this.mutex.Unlock()
+    return this.stopDriver(item.driver)
+}
+
+func (this *Supervisor) Drivers() []pmdrivers.Driverer {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    result := make([]pmdrivers.Driverer, 0, len(this.entries))
+    for i := range this.entries {
+        result = append(result, this.entries[i].driver)
+    }
+    return result
+}
+
+func (this *Supervisor) List() []*Supervision {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    result := make([]*Supervision, 0, len(this.entries))
+    for _, item := range this.entries {
+        result = append(result, &Supervision{
+            DriverId:       item.driver.GetId(),
+            State:          item.driver.GetStatus().State,
+            Restarts:       item.restarts,
+            Attempt:        item.attempt,
+            NextRestart:    item.nextRestart,
+            Quarantined:    item.quarantined,
+            LastError:      item.lastError,
+        })
+    }
+    return result
+}
+
+// Restart restarts the driver in background at once,
+// a quarantined driver is released
+func (this *Supervisor) Restart(driverId string) error {
+    this.mutex.Lock()
+    item := this.find(driverId)
+    if item == nil {
+        this.mutex.Unlock()
+        return errors.New("driver not found")
+    }
+    if this.closed {
+        this.mutex.Unlock()
+        return errors.New("supervisor is stopped")
+    }
+    if item.starting {
+        this.mutex.Unlock()
+        return errors.New("driver is starting")
+    }
+    if item.quarantined {
+        logger.Info("driver is released from quarantine", "driver", driverId)
+    }
+    item.quarantined = false
+    item.attempt     = 0
+    item.failures    = item.failures[:0]
+    item.nextRestart = time.Time{}
+    item.restarts++
+    item.starting    = true
+    this.spawn(func() { this.restartDriver(item) })
+    this.mutex.Unlock()
+    return nil
+}
+
+func (this *Supervisor) find(driverId string) *entry {
+    for i := range this.entries {
+        if this.entries[i].driver.GetId() == driverId {
+            return this.entries[i]
+        }
+    }
+    return nil
+}
+
+// Run watches drivers until the context is done
+func (this *Supervisor) Run(ctx context.Context) {
+    logger.Info("supervisor started")
+    timer := time.NewTicker(watchPeriod)
+    defer timer.Stop()
+    for {
+        select {
+            case <- ctx.Done():
+                logger.Info("supervisor stopped")
+                return
+            case now := <- timer.C:
+                this.watch(now)
+        }
+    }
+}
+
+// Wait waits for drivers being started, restarted
+// or stopped by the supervisor
+func (this *Supervisor) Wait() {
+    this.wg.Wait()
+}
+
+// spawn runs the function in background as part of the wait
+// group, the mutex must be locked, so StopAll either waits for
+// the function or the function is not spawned
+func (this *Supervisor) spawn(function func()) {
+    this.wg.Add(1)
+    go func() {
+        defer this.wg.Done()
+        function()
+    }()
+}
+
+// StopAll stops all drivers in parallel, drivers being
+// started are waited first. No drivers are added after.
+func (this *Supervisor) StopAll() error {
+    var err error
+    this.mutex.Lock()
+    this.closed = true
+    this.mutex.Unlock()
+    this.Wait()
+
+    var wg sync.WaitGroup
+    var errMutex sync.Mutex
+    for _, driver := range this.Drivers() {
+        wg.Add(1)
+        go func(driver pmdrivers.Driverer) {
+            defer wg.Done()
+            stopErr := this.stopDriver(driver)
+            if stopErr != nil {
+                logger.Error("unable stop driver", "driver", driver.GetId(), "error", stopErr)
+                errMutex.Lock()
+                err = stopErr
+                errMutex.Unlock()
+            }
+        }(driver)
+    }
+    wg.Wait()
+    return err
+}
+
+func (this *Supervisor) watch(now time.Time) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+
+    if this.closed {
+        return
+    }
+    for _, item := range this.entries {
+        if item.starting || item.quarantined {
+            continue
+        }
+        status := item.driver.GetStatus()
+        switch {
+            case status.State == pmdrivers.StateFailed || item.crashed:
+                if item.nextRestart.IsZero() {
+                    flapped := item.crashed || status.StartedAt.After(item.startedAt)
+                    this.scheduleRestart(item, now, status.LastError, flapped)
+                    continue
+                }
+                if now.Before(item.nextRestart) {
+                    continue
+                }
+                item.nextRestart = time.Time{}
+                item.restarts++
+                item.starting = true
+                logger.Info("restart driver", "driver", item.driver.GetId(), "attempt", item.attempt)
+                restarted := item
+                this.spawn(func() { this.restartDriver(restarted) })
+
+            case status.State == pmdrivers.StateRunning && item.attempt > 0:
+                if now.Sub(status.ChangedAt) > stablePeriod {
+                    item.attempt = 0
+                }
+        }
+    }
+}
+
+// scheduleRestart computes the next restart time or
+// quarantines the flapping driver
+func (this *Supervisor) scheduleRestart(item *entry, now time.Time, cause string, flapped bool) {
+    driverId := item.driver.GetId()
+    if len(cause) > 0 && !item.crashed {
+        item.lastError = cause
+    }
+
+    failures := make([]time.Time, 0, len(item.failures) + 1)
+    for _, failure := range item.failures {
+        if now.Sub(failure) < flapWindow {
+            failures = append(failures, failure)
+        }
+    }
+    if flapped {
+        failures = append(failures, now)
+    }
+    item.failures = failures
+
+    if len(item.failures) >= flapLimit {
+        item.quarantined = true
+        message := fmt.Sprintf("driver failed %d times within %s, quarantined: %s",
+                                len(item.failures), flapWindow, item.lastError)
+        logger.Error("driver is quarantined", "driver", driverId, "failures", len(item.failures),
+                            "window", flapWindow, "error", item.lastError)
+        if this.alerter != nil {
+            this.alerter.Emit(pmalert.NewAlert(pmalert.LevelCritical, alertSource, driverId, "", message))
+        }
+        driver := item.driver
+        this.spawn(func() { this.stopDriver(driver) })
+        return
+    }
+
+    delay := backoff(item.attempt)
+    item.attempt++
+    item.nextRestart = now.Add(delay)
+    logger.Warning("driver failed", "driver", driverId, "error", item.lastError,
+                        "restart", delay.Round(time.Millisecond))
+}
+
+// backoff doubles the delay with every attempt and
+// spreads it by jitter so drivers do not restart together
+func backoff(attempt int) time.Duration {
+    delay := minBackoff
+    for i := 0; i < attempt && delay < maxBackoff; i++ {
+        delay *= 2
+    }
+    if delay > maxBackoff {
+        delay = maxBackoff
+    }
+    jitter := (rand.Float64() * 2 - 1) * backoffJitter
+    return time.Duration(float64(delay) * (1 + jitter))
+}
+
+// startDriver connects and starts the driver in background
+// unless the supervisor is stopped
+func (this *Supervisor) startDriver(item *entry) {
+    this.mutex.Lock()
+    defer this.mutex.Unlock()
+    if this.closed || item.removed {
+        this.startDone(item)
+        return
+    }
+    item.startedAt = time.Now()
+
+    this.spawn(func() {
+        err := this.call(item, item.driver.ConnectDriver)
+        if err == nil {
+            err = this.call(item, item.driver.StartDriver)
+        }
+        this.mutex.Lock()
+        this.startDone(item)
+        if err != nil {
+            item.lastError = err.Error()
+        }
+        this.mutex.Unlock()
+    })
+}
+
+// startDone ends the driver start and wakes the removal
+// waiting for it, the mutex must be locked
+func (this *Supervisor) startDone(item *entry) {
+    item.starting = false
+    this.started.Broadcast()
+}
+
+// restartDriver stops the driver and starts it again,
+// the driver stays stopped when the supervisor is stopped
+func (this *Supervisor) restartDriver(item *entry) {
+    switch item.driver.GetStatus().State {
+        case pmdrivers.StateCreated, pmdrivers.StateStopped:
+        default:
+            this.call(item, item.driver.StopDriver)
+    }
+    this.mutex.Lock()
+    item.crashed = false
+    closed := this.closed || item.removed
+    if closed {
+        this.startDone(item)
+    }
+    this.mutex.Unlock()
+    if closed {
+        return
+    }
+    this.startDriver(item)
+}
+
+func (this *Supervisor) stopDriver(driver pmdrivers.Driverer) error {
+    switch driver.GetStatus().State {
+        case pmdrivers.StateStopped, pmdrivers.StateStopping:
+            return nil
+    }
+    return driver.StopDriver()
+}
+
+// call runs the driver lifecycle method, a panic is turned
+// into the error and the driver is restarted later
+func (this *Supervisor) call(item *entry, method func() error) (err error) {
+    defer func() {
+        if value := recover(); value != nil {
+            err = fmt.Errorf("panic: %v", value)
+            logger.Error("driver panic", "driver", item.driver.GetId(), "error", err,
+                            "stack", string(debug.Stack()))
+            this.mutex.Lock()
+            item.crashed = true
+            this.mutex.Unlock()
+        }
+    }()
+    return method()
+}
+//EOF
@@ -0,0 +1,352 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmtags
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "app/pmdrivers"
+    "app/pmtools"
+)
+
+const (
+    fileMode    os.FileMode = 0640
+)
+
+var (
+    ErrNotFound = errors.New("tag not found")
+    ErrSave     = errors.New("unable save tags")
+)
+
+//
+// Tag
+//
+type Tag struct {
+    Id          string              `json:"id"`
+    Mac         string              `json:"mac,omitempty"`
+    UUID        string              `json:"uuid,omitempty"`
+    Major       *int                `json:"major,omitempty"`
+    Minor       *int                `json:"minor,omitempty"`
+
+    Name        string              `json:"name"`
+    Owner       string              `json:"owner"`
+    Group       string              `json:"group"`
+    Denied      bool                `json:"denied"`
+    Metadata    map[string]string   `json:"metadata,omitempty"`
+
+    CreatedAt   time.Time           `json:"createdAt"`
+    UpdatedAt   time.Time           `json:"updatedAt"`
+}
+
+func NewTag() *Tag {
+    var tag Tag
+    tag.Metadata = make(map[string]string)
+    return &tag
+}
+
+func (this *Tag) ToJson() []byte {
+    jsonBytes, _ := json.Marshal(this)
+    return jsonBytes
+}
+
+func (this *Tag) Validate() error {
+    var err error
+    if len(this.Mac) == 0 && len(this.UUID) == 0 {
+        return errors.New("tag must have mac or uuid")
+    }
+    if len(this.UUID) == 0 && (this.Major != nil || this.Minor != nil) {
+        return errors.New("tag major and minor require uuid")
+    }
+    if this.Minor != nil && this.Major == nil {
+        return errors.New("tag minor requires major")
+    }
+    return err
+}
+
+// NormalizeMac brings "ac:23:3f:a0:01:02" and "AC233FA00102" to one form
+func NormalizeMac(mac string) string {
+    mac = strings.ToUpper(mac)
+    mac = strings.Replace(mac, ":", "", -1)
+    mac = strings.Replace(mac, "-", "", -1)
+    return mac
+}
+
+func uuidKey(uuid string, major, minor *int) string {
+    key := strings.ToUpper(strings.Replace(uuid, "-", "", -1))
+    if major != nil {
+        key += fmt.Sprintf("/%d", *major)
+        if minor != nil {
+            key += fmt.Sprintf("/%d", *minor)
+        }
+    }
+    return key
+}
+
+//
+// Registry
+//
+type Registry struct {
+    fileName    string
+    tags        map[string]*Tag
+    byMac       map[string]*Tag
+    byUUID      map[string]*Tag
+    mutex       sync.RWMutex
+    writeMutex  sync.Mutex
+}
+
+func NewRegistry(fileName string) *Registry {
+    var registry Registry
+    registry.fileName = fileName
+    registry.tags     = make(map[string]*Tag)
+    registry.reindex()
+    return &registry
+}
+
+func (this *Registry) reindex() {
+    this.byMac  = make(map[string]*Tag)
+    this.byUUID = make(map[string]*Tag)
+    for _, tag := range this.tags {
+        if len(tag.Mac) > 0 {
+            this.byMac[NormalizeMac(tag.Mac)] = tag
+        }
+        if len(tag.UUID) > 0 {
+            this.byUUID[uuidKey(tag.UUID, tag.Major, tag.Minor)] = tag
+        }
+    }
+}
+
+// Match finds the tag of the beacon by mac, then by the most
+// specific iBeacon uuid/major/minor
+func (this *Registry) Match(beacon *pmdrivers.IBeacon) *Tag {
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    return this.match(beacon)
+}
+
+func (this *Registry) match(beacon *pmdrivers.IBeacon) *Tag {
+    if tag, exists := this.byMac[NormalizeMac(beacon.Mac)]; exists {
+        return tag
+    }
+    if len(beacon.IbeaconUUID) == 0 {
+        return nil
+    }
+    major := beacon.IbeaconMajor
+    minor := beacon.IbeaconMinor
+    keys := []string{
+        uuidKey(beacon.IbeaconUUID, &major, &minor),
+        uuidKey(beacon.IbeaconUUID, &major, nil),
+        uuidKey(beacon.IbeaconUUID, nil, nil),
+    }
+    for _, key := range keys {
+        if tag, exists := this.byUUID[key]; exists {
+            return tag
+        }
+    }
+    return nil
+}
+
+func (this *Registry) Registered(beacon *pmdrivers.IBeacon) bool {
+    return this.Match(beacon) != nil
+}
+
+func (this *Registry) Denied(beacon *pmdrivers.IBeacon) bool {
+    tag := this.Match(beacon)
+    return tag != nil && tag.Denied
+}
+
+// GroupOf returns the group of the tag matched by mac
+// or by iBeacon uuid/major/minor
+func (this *Registry) GroupOf(beacon *pmdrivers.IBeacon) string {
+    if tag := this.Match(beacon); tag != nil {
+        return tag.Group
+    }
+    return ""
+}
+
+// checkUnique rejects the tag with mac or uuid/major/minor
+// of another tag, the mutex must be locked
+func (this *Registry) checkUnique(tag *Tag) error {
+    if len(tag.Mac) > 0 {
+        if other, exists := this.byMac[NormalizeMac(tag.Mac)]; exists && other.Id != tag.Id {
+            return fmt.Errorf("mac %s is registered by tag %s", tag.Mac, other.Name)
+        }
+    }
+    if len(tag.UUID) > 0 {
+        if other, exists := this.byUUID[uuidKey(tag.UUID, tag.Major, tag.Minor)]; exists && other.Id != tag.Id {
+            return fmt.Errorf("uuid %s is registered by tag %s", tag.UUID, other.Name)
+        }
+    }
+    return nil
+}
+
+// modify applies the change and saves tags, the change is
+// undone when tags can not be saved, so memory and file agree
+func (this *Registry) modify(change func() (undo func(), err error)) error {
+    this.writeMutex.Lock()
+    defer this.writeMutex.Unlock()
+
+    this.mutex.Lock()
+    undo, err := change()
+    if err != nil {
+        this.mutex.Unlock()
+        return err
+    }
+    this.reindex()
+    this.mutex.Unlock()
+
+    err = this.save()
+    if err != nil {
+        this.mutex.Lock()
+        undo()
+        this.reindex()
+        this.mutex.Unlock()
+        return fmt.Errorf("%w: %s", ErrSave, err)
+    }
+    return err
+}
+
+func (this *Registry) List() []*Tag {
+    this.mutex.RLock()
+    result := make([]*Tag, 0, len(this.tags))
+    for _, tag := range this.tags {
+        item := *tag
+        result = append(result, &item)
+    }
+    this.mutex.RUnlock()
+
+    sort.Slice(result, func(i, j int) bool {
+        return result[i].Name < result[j].Name
+    })
+    return result
+}
+
+func (this *Registry) Get(id string) (*Tag, error) {
+    var err error
+    this.mutex.RLock()
+    defer this.mutex.RUnlock()
+    tag, exists := this.tags[id]
+    if !exists {
+        return nil, ErrNotFound
+    }
+    item := *tag
+    return &item, err
+}
+
+func (this *Registry) Add(tag *Tag) (*Tag, error) {
+    var err error
+    err = tag.Validate()
+    if err != nil {
+        return nil, err
+    }
+    item := *tag
+    item.Id         = pmtools.GetNewUUID()
+    item.CreatedAt  = time.Now()
+    item.UpdatedAt  = item.CreatedAt
+
+    err = this.modify(func() (func(), error) {
+        err := this.checkUnique(&item)
+        if err != nil {
+            return nil, err
+        }
+        this.tags[item.Id] = &item
+        return func() { delete(this.tags, item.Id) }, err
+    })
+    if err != nil {
+        return nil, err
+    }
+    result := item
+    return &result, err
+}
+
+func (this *Registry) Update(id string, tag *Tag) (*Tag, error) {
+    var err error
+    err = tag.Validate()
+    if err != nil {
+        return nil, err
+    }
+    item := *tag
+    item.Id         = id
+    item.UpdatedAt  = time.Now()
+
+    err = this.modify(func() (func(), error) {
+        current, exists := this.tags[id]
+        if !exists {
+            return nil, ErrNotFound
+        }
+        err := this.checkUnique(&item)
+        if err != nil {
+            return nil, err
+        }
+        item.CreatedAt = current.CreatedAt
+        this.tags[id] = &item
+        return func() { this.tags[id] = current }, err
+    })
+    if err != nil {
+        return nil, err
+    }
+    result := item
+    return &result, err
+}
+
+func (this *Registry) Delete(id string) error {
+    return this.modify(func() (func(), error) {
+        current, exists := this.tags[id]
+        if !exists {
+            return nil, ErrNotFound
+        }
+        delete(this.tags, id)
+        return func() { this.tags[id] = current }, nil
+    })
+}
+
+func (this *Registry) Save() error {
+    this.writeMutex.Lock()
+    defer this.writeMutex.Unlock()
+    return this.save()
+}
+
+func (this *Registry) save() error {
+    var err error
+
+    this.mutex.RLock()
+    data, err := json.MarshalIndent(this.tags, "", "    ")
+    this.mutex.RUnlock()
+    if err != nil {
+        return err
+    }
+    return pmtools.WriteFileAtomic(this.fileName, data, fileMode)
+}
+
+func (this *Registry) Load() error {
+    var err error
+
+    data, err := ioutil.ReadFile(this.fileName)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    tags := make(map[string]*Tag)
+    err = json.Unmarshal(data, &tags)
+    if err != nil {
+        return err
+    }
+
+    this.mutex.Lock()
+    this.tags = tags
+    this.reindex()
+    this.mutex.Unlock()
+    return err
+}
+//EOF
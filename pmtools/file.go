@@ -0,0 +1,53 @@
+
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+
+package pmtools
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+)
+
+const (
+    filedirMode os.FileMode = 0750
+)
+
+// WriteFileAtomic writes data to a unique temporary file in the same
+// directory and renames it, so readers never see partially written
+// file and concurrent writers do not share the temporary file
+func WriteFileAtomic(fileName string, data []byte, mode os.FileMode) error {
+    var err error
+    dir := filepath.Dir(fileName)
+    err = os.MkdirAll(dir, filedirMode)
+    if err != nil {
+        return err
+    }
+    file, err := ioutil.TempFile(dir, filepath.Base(fileName) + ".*.tmp")
+    if err != nil {
+        return err
+    }
+    tmpName := file.Name()
+    _, err = file.Write(data)
+    if err == nil {
+        err = file.Sync()
+    }
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+    if err == nil {
+        err = os.Chmod(tmpName, mode)
+    }
+    if err == nil {
+        err = os.Rename(tmpName, fileName)
+    }
+    if err != nil {
+        os.Remove(tmpName)
+    }
+    return err
+}
+
+//EOF
@@ -0,0 +1,10 @@
+/*
+ * Copyright: Oleg Borodin <onborodin@gmail.com>
+ */
+
+package pmtools
+
+// SecretMask replaces secret values shown by the api
+// and printed configs
+const SecretMask string = "********"
+//EOF